@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// composeReplaceKeys are sequences replaced as a whole by an override.
+	composeReplaceKeys = map[string]bool{
+		"command":    true,
+		"entrypoint": true,
+		"test":       true,
+	}
+
+	// composeMapKeys are mappings which can also be written as KEY=VALUE lists.
+	composeMapKeys = map[string]bool{
+		"environment": true,
+		"labels":      true,
+		"annotations": true,
+		"sysctls":     true,
+		"args":        true,
+	}
+)
+
+// mergeCompose merges compose files in order with Docker Compose override semantics:
+// mappings are merged, sequences appended or replaced per key, and values tagged
+// !reset removed or !override replaced as a whole.
+func mergeCompose(names []string, contents []string) (string, error) {
+	var merged *yaml.Node
+
+	for i, content := range contents {
+		var doc yaml.Node
+		if err := yaml.Unmarshal([]byte(content), &doc); err != nil {
+			return "", fmt.Errorf("Compose file \"%s\" parsing error : %s", names[i], err)
+		}
+		if len(doc.Content) == 0 {
+			continue
+		}
+
+		root := doc.Content[0]
+		if root.Kind != yaml.MappingNode {
+			return "", fmt.Errorf("Compose file \"%s\" is not a mapping", names[i])
+		}
+
+		if merged == nil {
+			merged = resolveTags(root)
+		} else {
+			merged = mergeNode("", merged, root)
+		}
+	}
+
+	if merged == nil {
+		return "", fmt.Errorf("Compose files are empty")
+	}
+
+	return encodeYAML(merged)
+}
+
+func encodeYAML(n *yaml.Node) (string, error) {
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(n); err != nil {
+		return "", err
+	}
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+
+	return out.String(), nil
+}
+
+func mergeNode(key string, base, over *yaml.Node) *yaml.Node {
+	if over.Tag == "!override" {
+		return resolveTags(over)
+	}
+
+	if composeMapKeys[key] && base.Kind != over.Kind {
+		base, over = toMapping(base), toMapping(over)
+	}
+
+	switch {
+	case base.Kind == yaml.MappingNode && over.Kind == yaml.MappingNode:
+		return mergeMapping(base, over)
+	case base.Kind == yaml.SequenceNode && over.Kind == yaml.SequenceNode:
+		if composeMapKeys[key] {
+			return mergeMapping(toMapping(base), toMapping(over))
+		}
+		return mergeSequence(key, base, over)
+	}
+
+	return resolveTags(over)
+}
+
+func mergeMapping(base, over *yaml.Node) *yaml.Node {
+	out := *base
+	out.Content = append([]*yaml.Node{}, base.Content...)
+
+	for i := 0; i+1 < len(over.Content); i += 2 {
+		k, v := over.Content[i], over.Content[i+1]
+
+		j := mappingIndex(&out, k.Value)
+		switch {
+		case v.Tag == "!reset":
+			if j >= 0 {
+				out.Content = append(out.Content[:j], out.Content[j+2:]...)
+			}
+		case j >= 0:
+			out.Content[j+1] = mergeNode(k.Value, out.Content[j+1], v)
+		default:
+			out.Content = append(out.Content, k, resolveTags(v))
+		}
+	}
+
+	return &out
+}
+
+func mergeSequence(key string, base, over *yaml.Node) *yaml.Node {
+	if composeReplaceKeys[key] {
+		return resolveTags(over)
+	}
+
+	out := *base
+	out.Content = append([]*yaml.Node{}, base.Content...)
+
+	for _, v := range over.Content {
+		v = resolveTags(v)
+		id := sequenceKey(key, v)
+
+		replaced := false
+		for j, b := range out.Content {
+			if sequenceKey(key, b) == id {
+				out.Content[j] = v
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			out.Content = append(out.Content, v)
+		}
+	}
+
+	return &out
+}
+
+// sequenceKey identifies a sequence entry, so that overrides replace entries with the same target.
+func sequenceKey(key string, n *yaml.Node) string {
+	switch key {
+	case "volumes", "devices":
+		if n.Kind == yaml.ScalarNode {
+			parts := strings.Split(n.Value, ":")
+			if len(parts) > 1 {
+				return parts[1]
+			}
+			return parts[0]
+		}
+		if j := mappingIndex(n, "target"); j >= 0 {
+			return n.Content[j+1].Value
+		}
+	case "secrets", "configs":
+		if n.Kind == yaml.ScalarNode {
+			return n.Value
+		}
+		if j := mappingIndex(n, "source"); j >= 0 {
+			return n.Content[j+1].Value
+		}
+	}
+
+	if n.Kind == yaml.ScalarNode {
+		return n.Value
+	}
+
+	data, _ := yaml.Marshal(n)
+	return string(data)
+}
+
+func mappingIndex(n *yaml.Node, key string) int {
+	if n.Kind != yaml.MappingNode {
+		return -1
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// toMapping converts a KEY=VALUE sequence into a mapping.
+func toMapping(n *yaml.Node) *yaml.Node {
+	if n.Kind != yaml.SequenceNode {
+		return n
+	}
+
+	out := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for _, item := range n.Content {
+		kv := strings.SplitN(item.Value, "=", 2)
+
+		value := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null"}
+		if len(kv) == 2 {
+			value = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: kv[1]}
+		}
+
+		out.Content = append(out.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: kv[0]}, value)
+	}
+
+	return out
+}
+
+// resolveTags drops !reset entries and clears !override tags in a node taken from an override file.
+func resolveTags(n *yaml.Node) *yaml.Node {
+	out := *n
+	if out.Tag == "!override" || out.Tag == "!reset" {
+		out.Tag = ""
+	}
+
+	switch out.Kind {
+	case yaml.MappingNode:
+		out.Content = nil
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if n.Content[i+1].Tag == "!reset" {
+				continue
+			}
+			out.Content = append(out.Content, n.Content[i], resolveTags(n.Content[i+1]))
+		}
+	case yaml.SequenceNode:
+		out.Content = nil
+		for _, item := range n.Content {
+			out.Content = append(out.Content, resolveTags(item))
+		}
+	}
+
+	return &out
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Overrides follow the Docker Compose merge rules.
+func TestMergeCompose(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  string
+		err   bool
+	}{
+		{
+			name: "mappings merged, scalars replaced",
+			files: []string{
+				"services:\n  app:\n    image: app:1\n    restart: always\n",
+				"services:\n  app:\n    image: app:2\n  db:\n    image: db\n",
+			},
+			want: "services:\n  app:\n    image: app:2\n    restart: always\n  db:\n    image: db\n",
+		},
+		{
+			name: "sequences appended",
+			files: []string{
+				"services:\n  app:\n    ports: [\"80:80\"]\n",
+				"services:\n  app:\n    ports: [\"443:443\", \"80:80\"]\n",
+			},
+			want: "services:\n  app:\n    ports: [\"80:80\", \"443:443\"]\n",
+		},
+		{
+			name: "command replaced",
+			files: []string{
+				"services:\n  app:\n    command: [serve, --debug]\n",
+				"services:\n  app:\n    command: [serve]\n",
+			},
+			want: "services:\n  app:\n    command: [serve]\n",
+		},
+		{
+			name: "environment list and mapping merged",
+			files: []string{
+				"services:\n  app:\n    environment:\n      - A=1\n      - B=2\n",
+				"services:\n  app:\n    environment:\n      B: 3\n      C: 4\n",
+			},
+			want: "services:\n  app:\n    environment:\n      A: \"1\"\n      B: 3\n      C: 4\n",
+		},
+		{
+			name: "volumes keyed by target",
+			files: []string{
+				"services:\n  app:\n    volumes: [\"./a:/data\", \"logs:/logs\"]\n",
+				"services:\n  app:\n    volumes: [\"./b:/data:ro\"]\n",
+			},
+			want: "services:\n  app:\n    volumes: [\"./b:/data:ro\", \"logs:/logs\"]\n",
+		},
+		{
+			name: "secrets keyed by source",
+			files: []string{
+				"services:\n  app:\n    secrets: [{source: db, target: db_password}, api]\n",
+				"services:\n  app:\n    secrets: [{source: db, target: password}]\n",
+			},
+			want: "services:\n  app:\n    secrets: [{source: db, target: password}, api]\n",
+		},
+		{
+			name: "reset removes",
+			files: []string{
+				"services:\n  app:\n    image: app\n    ports: [\"80:80\"]\n",
+				"services:\n  app:\n    ports: !reset []\n",
+			},
+			want: "services:\n  app:\n    image: app\n",
+		},
+		{
+			name: "override replaces",
+			files: []string{
+				"services:\n  app:\n    deploy:\n      replicas: 2\n      mode: replicated\n",
+				"services:\n  app:\n    deploy: !override\n      replicas: 1\n",
+			},
+			want: "services:\n  app:\n    deploy:\n      replicas: 1\n",
+		},
+		{
+			name:  "empty files skipped",
+			files: []string{"", "services:\n  app:\n    image: app\n"},
+			want:  "services:\n  app:\n    image: app\n",
+		},
+		{
+			name:  "all empty",
+			files: []string{"", ""},
+			err:   true,
+		},
+		{
+			name:  "not a mapping",
+			files: []string{"- app\n"},
+			err:   true,
+		},
+		{
+			name:  "invalid",
+			files: []string{"services: [\n"},
+			err:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names := make([]string, len(tt.files))
+			for i := range names {
+				names[i] = "docker-compose.yml"
+			}
+
+			got, err := mergeCompose(names, tt.files)
+			if (err != nil) != tt.err {
+				t.Fatalf("mergeCompose() error = %v, want error %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+
+			var gotValue, wantValue interface{}
+			if err := yaml.Unmarshal([]byte(got), &gotValue); err != nil {
+				t.Fatalf("mergeCompose() returned invalid YAML: %s\n%s", err, got)
+			}
+			if err := yaml.Unmarshal([]byte(tt.want), &wantValue); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotValue, wantValue) {
+				t.Errorf("mergeCompose() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
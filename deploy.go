@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/maniack/drone-portainer/lib/portainer"
+)
+
+const (
+	StackConflictError   = "error"
+	StackConflictAdopt   = "adopt"
+	StackConflictMigrate = "migrate"
+)
+
+// RollbackTimeout bounds a rollback, which still runs when the step was
+// interrupted or timed out.
+const RollbackTimeout = 2 * time.Minute
+
+// deploy creates or updates a single stack, logging an event for each phase.
+func (p Plugin) deploy(ctx context.Context, prtnr *portainer.Portainer, s Stack, log *slog.Logger) error {
+	endpoint, err := p.selectEndpoint(ctx, prtnr, s, log)
+	if err != nil {
+		return err
+	}
+
+	if endpoint.IsKubernetes() {
+		switch s.Type {
+		case "", "auto", "kubernetes":
+		default:
+			return fmt.Errorf("Stack type \"%s\" not supported on Kubernetes endpoint \"%s\"", s.Type, endpoint.Name)
+		}
+		if s.Wait {
+			return fmt.Errorf("Waiting for rollout not supported on Kubernetes endpoint \"%s\"", endpoint.Name)
+		}
+		if p.Config.Git.URL != "" {
+			return fmt.Errorf("Git deployment not supported on Kubernetes endpoint \"%s\"", endpoint.Name)
+		}
+		if len(s.Environment) > 0 || len(s.EnvFiles) > 0 {
+			return fmt.Errorf("Stack environment not supported on Kubernetes endpoint \"%s\"", endpoint.Name)
+		}
+		if len(p.Config.Secrets) > 0 {
+			log.Warn("Secrets are only available to templates on Kubernetes endpoints", "endpoint", endpoint.Name)
+		}
+	} else {
+		switch s.Type {
+		case "", "auto":
+		case "swarm":
+			if endpoint.SwarmID == "" {
+				return fmt.Errorf("Endpoint \"%s\" is not in swarm mode", endpoint.Name)
+			}
+			endpoint.StackType = portainer.StackTypeSwarm
+		case "compose":
+			endpoint.StackType = portainer.StackTypeCompose
+		default:
+			return fmt.Errorf("Unknown stack type \"%s\"", s.Type)
+		}
+	}
+
+	stack, endpoint, err := p.findStack(ctx, prtnr, endpoint, s, log)
+	if err != nil {
+		return err
+	}
+
+	if stack != nil && stack.Type != 0 {
+		endpoint.StackType = stack.Type
+	}
+
+	var current []*portainer.Env
+	if stack != nil {
+		current = stack.Env
+	}
+
+	env, err := p.stackEnv(s, current)
+	if err != nil {
+		return err
+	}
+
+	stack_config, err := p.stackConfig(s, env, log)
+	if err != nil {
+		return err
+	}
+	if endpoint.IsKubernetes() {
+		// Kubernetes stacks have no environment, the secrets only served the templates
+		env = nil
+	}
+
+	if p.Config.Preview.Enabled && stack_config != "" && !endpoint.IsKubernetes() {
+		stack_config, err = p.previewLabels(stack_config, endpoint.StackType == portainer.StackTypeSwarm)
+		if err != nil {
+			return err
+		}
+	}
+
+	var rotated []*rotatedObject
+	if s.Rotate {
+		if p.Config.Git.URL != "" || endpoint.StackType != portainer.StackTypeSwarm {
+			return fmt.Errorf("Configs and secrets rotation is only supported for swarm stacks deployed from a stack file")
+		}
+
+		ph := begin(log, "rotate", "Rotate stack configs and secrets")
+		stack_config, rotated, err = p.rotate(ctx, prtnr, endpoint, s, stack_config, !p.Config.DryRun)
+		if err != nil {
+			return ph.fail(err)
+		}
+		ph.ok("objects", len(rotated))
+	}
+
+	if p.Config.DryRun {
+		return p.dryRun(ctx, prtnr, s, endpoint, stack, stack_config, env, log)
+	}
+
+	var previous string
+	if s.Rollback && stack != nil && stack.GitConfig == nil {
+		ph := begin(log, "save", "Save stack for rollback")
+		previous, err = prtnr.GetStackFileContext(ctx, stack)
+		if err != nil {
+			return ph.fail(err)
+		}
+		ph.ok()
+	}
+
+	// services as they are before the update, to tell the new tasks from the old ones
+	var services []*portainer.Service
+	if s.Wait && stack != nil && endpoint.StackType == portainer.StackTypeSwarm {
+		services, err = prtnr.GetStackServicesContext(ctx, endpoint, s.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if stack != nil {
+		ph := begin(log, "update", "Update stack", "stack_id", stack.Id)
+
+		var err error
+		switch {
+		case p.Config.Git.URL != "":
+			err = prtnr.RedeployStackFromGitContext(ctx, stack, p.Config.Git.Repository(), p.Config.Git.Prune, p.Config.Git.Pull, env...)
+		case endpoint.IsKubernetes():
+			err = prtnr.UpdateKubernetesStackFromStringContext(ctx, stack, stack_config)
+		default:
+			err = prtnr.UpdateStackFromStringContext(ctx, stack, stack_config, true, env...)
+		}
+		if err != nil {
+			return p.rollback(ctx, prtnr, stack, previous, ph.fail(err), log)
+		}
+		ph.ok()
+	} else {
+		ph := begin(log, "deploy", "Deploy stack")
+
+		var err error
+		switch {
+		case p.Config.Git.URL != "":
+			err = prtnr.DeployStackFromGitRepositoryContext(ctx, endpoint, s.Name, p.Config.Git.Repository(), env...)
+		case endpoint.IsKubernetes():
+			err = prtnr.DeployKubernetesStackFromStringContext(ctx, endpoint, s.Name, s.Namespace, s.Kompose, stack_config)
+		default:
+			err = prtnr.DeployStackFromStringContext(ctx, endpoint, s.Name, stack_config, env...)
+		}
+		if err != nil {
+			return ph.fail(err)
+		}
+		ph.ok()
+	}
+
+	if s.Wait {
+		ph := begin(log, "wait", "Wait for stack rollout")
+		err := prtnr.WaitStackContext(ctx, endpoint, s.Name, services, s.WaitTimeout, s.WaitInterval)
+		if err != nil {
+			return p.rollback(ctx, prtnr, stack, previous, ph.fail(err), log)
+		}
+		ph.ok()
+	}
+
+	if len(rotated) > 0 {
+		p.pruneRotated(ctx, prtnr, endpoint, rotated, s.RotateRetention, log)
+	}
+
+	return nil
+}
+
+func (p Plugin) selectEndpoint(ctx context.Context, prtnr *portainer.Portainer, s Stack, log *slog.Logger) (*portainer.Endpoint, error) {
+	name := s.Endpoint
+	if name == "" {
+		name = p.Config.Portainer.Endpoint
+	}
+
+	ph := begin(log, "select_endpoint", "Select endpoint", "selector", name)
+	var (
+		endpoint *portainer.Endpoint
+		err      error
+	)
+	if s.EndpointID != 0 {
+		endpoint, err = prtnr.GetEndpointByIDContext(ctx, s.EndpointID)
+	} else {
+		endpoint, err = prtnr.GetEndpointByNameContext(ctx, name)
+	}
+	if err != nil {
+		return nil, ph.fail(err)
+	}
+	ph.ok("endpoint_id", endpoint.Id)
+
+	return endpoint, nil
+}
+
+// findStack looks up the stack on the endpoint. A stack with the same name on other
+// endpoints, or in another swarm cluster of the endpoint, is an error unless the
+// conflict policy adopts it where it is or migrates it to the endpoint; the endpoint
+// of the stack is returned along with it.
+func (p Plugin) findStack(ctx context.Context, prtnr *portainer.Portainer, endpoint *portainer.Endpoint, s Stack, log *slog.Logger) (*portainer.Stack, *portainer.Endpoint, error) {
+	ph := begin(log, "search_stack", "Search stack")
+	stack, err := prtnr.GetStackContext(ctx, endpoint, s.Name)
+	if err != nil {
+		return nil, nil, ph.fail(err)
+	}
+	if stack != nil {
+		ph.ok("found", true, "stack_id", stack.Id)
+		return stack, endpoint, nil
+	}
+
+	stacks, err := prtnr.GetStacksContext(ctx)
+	if err != nil {
+		return nil, nil, ph.fail(err)
+	}
+
+	// stacks of the endpoint with the name are swarm stacks of another cluster,
+	// GetStack would have returned any other
+	var others []*portainer.Stack
+	for _, stack := range stacks {
+		if stack.Name == s.Name {
+			others = append(others, stack)
+		}
+	}
+	if len(others) == 0 {
+		ph.ok("found", false)
+		return nil, endpoint, nil
+	}
+
+	names := map[int]string{}
+	if endpoints, err := prtnr.GetEndpointsContext(ctx); err == nil {
+		for _, e := range endpoints {
+			names[e.Id] = e.Name
+		}
+	}
+
+	var where []string
+	for _, stack := range others {
+		if stack.Type == portainer.StackTypeSwarm && stack.SwarmID != "" {
+			where = append(where, fmt.Sprintf("endpoint \"%s\" (stack %d, swarm \"%s\")", names[stack.EndpointID], stack.Id, stack.SwarmID))
+		} else {
+			where = append(where, fmt.Sprintf("endpoint \"%s\" (stack %d)", names[stack.EndpointID], stack.Id))
+		}
+	}
+
+	switch {
+	case s.Conflict == "" || s.Conflict == StackConflictError:
+		return nil, nil, ph.fail(fmt.Errorf("Stack \"%s\" not found on endpoint \"%s\" but exists on %s; set conflict to \"%s\" or \"%s\" to use it",
+			s.Name, endpoint.Name, strings.Join(where, ", "), StackConflictAdopt, StackConflictMigrate))
+	case s.Conflict != StackConflictAdopt && s.Conflict != StackConflictMigrate:
+		return nil, nil, ph.fail(fmt.Errorf("Unknown stack conflict policy \"%s\"", s.Conflict))
+	case len(others) > 1:
+		return nil, nil, ph.fail(fmt.Errorf("Stack \"%s\" is ambiguous, it exists on %s", s.Name, strings.Join(where, ", ")))
+	}
+
+	stack = others[0]
+
+	owner := endpoint
+	if stack.EndpointID != endpoint.Id {
+		owner, err = prtnr.GetEndpointByIDContext(ctx, stack.EndpointID)
+		if err != nil {
+			return nil, nil, ph.fail(err)
+		}
+	}
+	ph.ok("found", true, "stack_id", stack.Id, "owner", owner.Name)
+
+	if s.Conflict == StackConflictAdopt {
+		log.Info("Adopt stack", "owner", owner.Name)
+		return stack, owner, nil
+	}
+
+	if p.Config.DryRun {
+		log.Info("Stack would be migrated", "source", owner.Name, "target", endpoint.Name)
+		return stack, owner, nil
+	}
+
+	ph = begin(log, "migrate", "Migrate stack", "source", owner.Name, "target", endpoint.Name)
+	err = prtnr.MigrateStackContext(ctx, stack, endpoint, "")
+	if err != nil {
+		return nil, nil, ph.fail(err)
+	}
+
+	stack, err = prtnr.GetStackContext(ctx, endpoint, s.Name)
+	if err != nil {
+		return nil, nil, ph.fail(err)
+	}
+	if stack == nil {
+		return nil, nil, ph.fail(fmt.Errorf("Stack \"%s\" not found on endpoint \"%s\" after migration", s.Name, endpoint.Name))
+	}
+	ph.ok()
+
+	return stack, endpoint, nil
+}
+
+// stackConfig builds the stack file sent to Portainer from the inline config or the
+// stack files, rendered and merged as configured. It is empty for git stacks.
+func (p Plugin) stackConfig(s Stack, env []*portainer.Env, log *slog.Logger) (string, error) {
+	if p.Config.Git.URL != "" {
+		return "", nil
+	}
+
+	var names, contents []string
+	if len(s.Config) > 0 {
+		names = append(names, "config")
+		contents = append(contents, strings.Join(s.Config, "\n"))
+	} else {
+		files := s.Files
+		if len(files) == 0 && s.Path != "" {
+			files = []string{s.Path}
+		}
+
+		for _, file := range files {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return "", err
+			}
+			names = append(names, file)
+			contents = append(contents, string(data))
+		}
+	}
+
+	if len(contents) == 0 {
+		return "", fmt.Errorf("Stack config not defined")
+	}
+
+	if s.Template {
+		ph := begin(log, "render", "Render stack template")
+		for i := range contents {
+			var err error
+			contents[i], err = p.render(s, contents[i], env)
+			if err != nil {
+				return "", ph.fail(err)
+			}
+		}
+		ph.ok()
+	}
+
+	config := contents[0]
+	if len(contents) > 1 {
+		ph := begin(log, "merge", "Merge stack files", "files", len(contents))
+		var err error
+		config, err = mergeCompose(names, contents)
+		if err != nil {
+			return "", ph.fail(err)
+		}
+		ph.ok()
+	}
+
+	if s.Print {
+		log.Info("Stack file", "file", strings.TrimRight(config, "\n")+"\n")
+	}
+
+	return config, nil
+}
+
+// rollback restores the saved stack file and environment after a failed update.
+func (p Plugin) rollback(ctx context.Context, prtnr *portainer.Portainer, stack *portainer.Stack, previous string, cause error, log *slog.Logger) error {
+	if previous == "" {
+		return cause
+	}
+
+	// ctx may be done already, which is often why the update failed
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), RollbackTimeout)
+	defer cancel()
+
+	ph := begin(log, "rollback", "Roll back stack")
+	var err error
+	if stack.Type == portainer.StackTypeKubernetes {
+		err = prtnr.UpdateKubernetesStackFromStringContext(ctx, stack, previous)
+	} else {
+		err = prtnr.UpdateStackFromStringContext(ctx, stack, previous, true, stack.Env...)
+	}
+	if err != nil {
+		ph.fail(err)
+		return fmt.Errorf("%s\nRollback of stack \"%s\" failed: %s", cause, stack.Name, err)
+	}
+	ph.ok()
+
+	return fmt.Errorf("%s\nStack \"%s\" rolled back to previous version", cause, stack.Name)
+}
+
+// dryRun logs what a deploy would change without calling any mutating API.
+func (p Plugin) dryRun(ctx context.Context, prtnr *portainer.Portainer, s Stack, endpoint *portainer.Endpoint, stack *portainer.Stack, config string, env []*portainer.Env, log *slog.Logger) error {
+	var current []*portainer.Env
+	if stack != nil {
+		current = stack.Env
+	}
+
+	var args []any
+	if diff := envDiff(current, env); diff != "" {
+		args = append(args, "environment", strings.TrimRight(diff, "\n")+"\n")
+	}
+
+	if p.Config.Git.URL != "" {
+		repo := p.Config.Git.URL
+		if p.Config.Git.Reference != "" {
+			repo = fmt.Sprintf("%s@%s", repo, p.Config.Git.Reference)
+		}
+
+		if stack == nil {
+			log.Info("Stack would be created", append([]any{"repository", repo}, args...)...)
+		} else {
+			log.Info("Stack would be redeployed", append([]any{"repository", repo}, args...)...)
+		}
+		return nil
+	}
+
+	if stack == nil {
+		switch endpoint.StackType {
+		case portainer.StackTypeKubernetes:
+			args = append([]any{"type", "kubernetes", "namespace", s.Namespace}, args...)
+		case portainer.StackTypeSwarm:
+			args = append([]any{"type", "swarm", "swarm_id", endpoint.SwarmID}, args...)
+		default:
+			args = append([]any{"type", "compose"}, args...)
+		}
+		log.Info("Stack would be created", args...)
+		return nil
+	}
+
+	ph := begin(log, "fetch_file", "Fetch stack file")
+	file, err := prtnr.GetStackFileContext(ctx, stack)
+	if err != nil {
+		return ph.fail(err)
+	}
+	ph.ok()
+
+	diff := unifiedDiff(fmt.Sprintf("%s (portainer)", stack.Name), fmt.Sprintf("%s (local)", stack.Name), file, config)
+	args = append([]any{"file_changed", diff != "", "env_changed", len(args) > 0}, args...)
+	if diff != "" {
+		args = append(args, "diff", diff)
+	}
+	log.Info("Stack would be updated", args...)
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/maniack/drone-portainer/lib/portainer"
+)
+
+// A swarm stack left behind by an earlier cluster of the endpoint is a conflict
+// which the policy resolves, not a missing stack to deploy again.
+func TestFindStackInAnotherSwarm(t *testing.T) {
+	tests := []struct {
+		conflict string
+		err      string
+		migrated bool
+	}{
+		{conflict: "", err: `endpoint "swarm" (stack 2, swarm "old")`},
+		{conflict: StackConflictAdopt},
+		{conflict: StackConflictMigrate, migrated: true},
+	}
+
+	for _, tt := range tests {
+		var mu sync.Mutex
+		swarmID, migrated := "old", false
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch {
+			case r.Method == "POST" && r.URL.Path == "/api/stacks/2/migrate":
+				swarmID, migrated = "current", true
+				w.Write([]byte(`{}`))
+			case r.URL.Path == "/api/stacks":
+				w.Write([]byte(`[
+					{"Id":1,"Name":"web","Type":1,"EndpointID":1,"SwarmID":"current"},
+					{"Id":2,"Name":"api","Type":1,"EndpointID":1,"SwarmID":"` + swarmID + `"}
+				]`))
+			case r.URL.Path == "/api/endpoints":
+				w.Write([]byte(`[{"Id":1,"Name":"swarm"}]`))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+
+		prtnr, err := portainer.NewPortainer(srv.URL, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoint := &portainer.Endpoint{Id: 1, Name: "swarm", SwarmID: "current", StackType: portainer.StackTypeSwarm}
+		log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+		stack, owner, err := Plugin{}.findStack(context.Background(), prtnr, endpoint, Stack{Name: "api", Conflict: tt.conflict}, log)
+		srv.Close()
+
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("findStack(%q) error = %v, want it to mention %s", tt.conflict, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("findStack(%q) error = %v", tt.conflict, err)
+			continue
+		}
+		if stack == nil || stack.Id != 2 || owner != endpoint {
+			t.Errorf("findStack(%q) = %+v on %+v, want stack 2 on the endpoint", tt.conflict, stack, owner)
+		}
+		if migrated != tt.migrated {
+			t.Errorf("findStack(%q) migrated = %v, want %v", tt.conflict, migrated, tt.migrated)
+		}
+	}
+}
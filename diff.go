@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/maniack/drone-portainer/lib/portainer"
+)
+
+const diffContext = 3
+
+type diffLine struct {
+	op   byte
+	text string
+}
+
+func splitLines(s string) []string {
+	s = strings.TrimSuffix(strings.Replace(s, "\r\n", "\n", -1), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// diffLines returns the edit script between a and b based on their longest common subsequence.
+func diffLines(a, b []string) []diffLine {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var lines []diffLine
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, diffLine{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, diffLine{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, diffLine{'+', b[j]})
+	}
+
+	return lines
+}
+
+// unifiedDiff renders the difference between two texts in unified diff format.
+func unifiedDiff(from, to, a, b string) string {
+	lines := diffLines(splitLines(a), splitLines(b))
+
+	// line numbers in a and b preceding every edit
+	apos := make([]int, len(lines)+1)
+	bpos := make([]int, len(lines)+1)
+	for k, l := range lines {
+		apos[k+1], bpos[k+1] = apos[k], bpos[k]
+		if l.op != '+' {
+			apos[k+1]++
+		}
+		if l.op != '-' {
+			bpos[k+1]++
+		}
+	}
+
+	var out strings.Builder
+	for k := 0; k < len(lines); {
+		if lines[k].op == ' ' {
+			k++
+			continue
+		}
+
+		start := k - diffContext
+		if start < 0 {
+			start = 0
+		}
+
+		end := k
+		for end < len(lines) {
+			if lines[end].op != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(lines) && lines[run].op == ' ' {
+				run++
+			}
+			if run == len(lines) || run-end > 2*diffContext {
+				break
+			}
+			end = run
+		}
+
+		stop := end + diffContext
+		if stop > len(lines) {
+			stop = len(lines)
+		}
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", from, to)
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n",
+			hunkRange(apos[start], apos[stop]-apos[start]),
+			hunkRange(bpos[start], bpos[stop]-bpos[start]))
+		for _, l := range lines[start:stop] {
+			fmt.Fprintf(&out, "%c%s\n", l.op, l.text)
+		}
+
+		k = stop
+	}
+
+	return out.String()
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// envDiff lists the names of added, removed and changed variables.
+// Values are left out as they often carry secrets.
+func envDiff(current, desired []*portainer.Env) string {
+	before := map[string]string{}
+	for _, e := range current {
+		before[e.Name] = e.Value
+	}
+	after := map[string]string{}
+	for _, e := range desired {
+		after[e.Name] = e.Value
+	}
+
+	var lines []string
+	for name, value := range after {
+		if old, ok := before[name]; !ok {
+			lines = append(lines, "+ "+name)
+		} else if old != value {
+			lines = append(lines, "~ "+name)
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			lines = append(lines, "- "+name)
+		}
+	}
+
+	sort.Slice(lines, func(i, j int) bool { return lines[i][2:] < lines[j][2:] })
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// numbered returns the lines from to to, replacing those in change.
+func numbered(from, to int, change map[int]string) string {
+	var lines []string
+	for i := from; i <= to; i++ {
+		line := fmt.Sprintf("%d", i)
+		if c, ok := change[i]; ok {
+			line = c
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Removals come before additions where a line is replaced.
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		a, b []string
+		want []diffLine
+	}{
+		{nil, nil, nil},
+		{nil, []string{"a"}, []diffLine{{'+', "a"}}},
+		{[]string{"a"}, nil, []diffLine{{'-', "a"}}},
+		{[]string{"a", "b", "c"}, []string{"a", "c", "d"}, []diffLine{{' ', "a"}, {'-', "b"}, {' ', "c"}, {'+', "d"}}},
+		{[]string{"a", "b"}, []string{"a", "x"}, []diffLine{{' ', "a"}, {'-', "b"}, {'+', "x"}}},
+	}
+
+	for _, tt := range tests {
+		if got := diffLines(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("diffLines(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// Line ending and trailing newline differences are no changes.
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{"unchanged", "a\nb\n", "a\nb\n", ""},
+		{"empty", "", "", ""},
+		{"created", "", "a\nb\n", "--- current\n+++ desired\n@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{"deleted", "a\nb\n", "", "--- current\n+++ desired\n@@ -1,2 +0,0 @@\n-a\n-b\n"},
+		{"one line", "a\n", "b\n", "--- current\n+++ desired\n@@ -1 +1 @@\n-a\n+b\n"},
+		{"trailing newline", "a\nb", "a\nb\n", ""},
+		{"line endings", "a\r\nb\r\n", "a\nb\n", ""},
+		{"line endings and change", "a\r\nb\r\n", "a\nc\n", "--- current\n+++ desired\n@@ -1,2 +1,2 @@\n a\n-b\n+c\n"},
+		{
+			"context",
+			numbered(1, 10, nil),
+			numbered(1, 10, map[int]string{5: "x"}),
+			"--- current\n+++ desired\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+x\n 6\n 7\n 8\n",
+		},
+		{
+			"added in the middle",
+			numbered(1, 4, nil),
+			"1\n2\nx\n3\n4\n",
+			"--- current\n+++ desired\n@@ -1,4 +1,5 @@\n 1\n 2\n+x\n 3\n 4\n",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := unifiedDiff("current", "desired", tt.a, tt.b); got != tt.want {
+			t.Errorf("unifiedDiff() %s = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Changes up to twice the context apart share a hunk, further ones get their own.
+func TestUnifiedDiffHunks(t *testing.T) {
+	tests := []struct {
+		change  map[int]string
+		headers []string
+	}{
+		{map[int]string{3: "c", 10: "j"}, []string{"@@ -1,13 +1,13 @@"}},
+		{map[int]string{3: "c", 11: "k"}, []string{"@@ -1,6 +1,6 @@", "@@ -8,7 +8,7 @@"}},
+		{map[int]string{1: "a", 20: "t"}, []string{"@@ -1,4 +1,4 @@", "@@ -17,4 +17,4 @@"}},
+	}
+
+	for _, tt := range tests {
+		diff := unifiedDiff("current", "desired", numbered(1, 20, nil), numbered(1, 20, tt.change))
+
+		var headers []string
+		for _, line := range strings.Split(diff, "\n") {
+			if strings.HasPrefix(line, "@@") {
+				headers = append(headers, line)
+			}
+		}
+		if !reflect.DeepEqual(headers, tt.headers) {
+			t.Errorf("unifiedDiff() with %v has hunks %q, want %q", tt.change, headers, tt.headers)
+		}
+	}
+}
+
+// Ranges are 1-based, empty ones name the line before them.
+func TestHunkRange(t *testing.T) {
+	tests := []struct {
+		start, count int
+		want         string
+	}{
+		{0, 0, "0,0"},
+		{3, 0, "3,0"},
+		{0, 1, "1"},
+		{4, 1, "5"},
+		{4, 3, "5,3"},
+	}
+
+	for _, tt := range tests {
+		if got := hunkRange(tt.start, tt.count); got != tt.want {
+			t.Errorf("hunkRange(%d, %d) = %q, want %q", tt.start, tt.count, got, tt.want)
+		}
+	}
+}
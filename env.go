@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/maniack/drone-portainer/lib/portainer"
+)
+
+const (
+	EnvPolicyReplace = "replace"
+	EnvPolicyKeep    = "keep"
+	EnvPolicyAdd     = "add"
+)
+
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// stackEnv builds the stack environment from the env files, the secrets and the
+// inline environment, and merges it with the current stack environment.
+func (p Plugin) stackEnv(s Stack, current []*portainer.Env) ([]*portainer.Env, error) {
+	var env []*portainer.Env
+
+	for _, file := range s.EnvFiles {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		vars, err := parseDotenv(file, string(data), lookupEnv(env, p.Config.Secrets))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range vars {
+			env = setEnv(env, e.Name, e.Value)
+		}
+	}
+
+	secrets, err := secretEnv(p.Config.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range secrets {
+		env = setEnv(env, e.Name, e.Value)
+	}
+
+	for _, v := range s.Environment {
+		e := strings.SplitN(v, "=", 2)
+		if len(e) != 2 || !envName.MatchString(e[0]) {
+			return nil, fmt.Errorf("Stack environment \"%s\" is not in KEY=VALUE format", v)
+		}
+		env = setEnv(env, e[0], e[1])
+	}
+
+	return mergeEnv(s.EnvPolicy, current, env)
+}
+
+// secretEnv reads the secrets setting from the process environment. Entries are
+// variable names, SRC:DEST renames or glob patterns such as APP_*.
+func secretEnv(secrets []string) ([]*portainer.Env, error) {
+	var env []*portainer.Env
+
+	for _, secret := range secrets {
+		src, dest := secret, secret
+		if i := strings.Index(secret, ":"); i >= 0 {
+			src, dest = secret[:i], secret[i+1:]
+		}
+
+		if strings.ContainsAny(src, "*?[") {
+			if dest != src {
+				return nil, fmt.Errorf("Secret pattern \"%s\" can not be renamed", src)
+			}
+			if _, err := path.Match(src, ""); err != nil {
+				return nil, fmt.Errorf("Secret pattern \"%s\" is invalid: %s", src, err)
+			}
+
+			environ := os.Environ()
+			sort.Strings(environ)
+			for _, kv := range environ {
+				e := strings.SplitN(kv, "=", 2)
+				if ok, _ := path.Match(src, e[0]); ok && len(e) == 2 {
+					env = setEnv(env, e[0], e[1])
+				}
+			}
+			continue
+		}
+
+		if !envName.MatchString(src) || !envName.MatchString(dest) {
+			return nil, fmt.Errorf("Secret \"%s\" is not a variable name", secret)
+		}
+
+		value, ok := os.LookupEnv(src)
+		if !ok {
+			return nil, fmt.Errorf("Secret \"%s\" not found in environment", src)
+		}
+		env = setEnv(env, dest, value)
+	}
+
+	return env, nil
+}
+
+// secretSelected reports whether the secrets setting selects the variable.
+func secretSelected(secrets []string, name string) bool {
+	for _, secret := range secrets {
+		src := secret
+		if i := strings.Index(secret, ":"); i >= 0 {
+			src = secret[:i]
+		}
+		if ok, _ := path.Match(src, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// envExposed reports whether stack files and env files may read the process
+// environment variable: build variables and the secrets selected by the secrets
+// setting are, the plugin settings such as the Portainer password are not.
+func envExposed(secrets []string, name string) bool {
+	return strings.HasPrefix(name, "DRONE_") || strings.HasPrefix(name, "CI_") || secretSelected(secrets, name)
+}
+
+// redactor returns a function masking the values of secrets in text which is about
+// to be logged, both as they are and escaped in JSON.
+func (p Plugin) redactor() (func(string) string, error) {
+	secrets, err := secretEnv(p.Config.Secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var values []string
+	for _, e := range secrets {
+		if e.Value == "" {
+			continue
+		}
+
+		forms := []string{e.Value}
+		for _, html := range []bool{true, false} {
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			enc.SetEscapeHTML(html)
+			if enc.Encode(e.Value) == nil {
+				forms = append(forms, strings.TrimSuffix(strings.TrimPrefix(strings.TrimRight(buf.String(), "\n"), `"`), `"`))
+			}
+		}
+		for _, form := range forms {
+			if !seen[form] {
+				seen[form] = true
+				values = append(values, form)
+			}
+		}
+	}
+
+	// longer values first, so that a secret containing another one is masked whole
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+
+	var pairs []string
+	for _, value := range values {
+		pairs = append(pairs, value, "********")
+	}
+	return strings.NewReplacer(pairs...).Replace, nil
+}
+
+// mergeEnv applies the merge policy to the current and desired stack environment.
+func mergeEnv(policy string, current, desired []*portainer.Env) ([]*portainer.Env, error) {
+	switch policy {
+	case "", EnvPolicyReplace:
+		return desired, nil
+	case EnvPolicyKeep:
+		env := append([]*portainer.Env{}, desired...)
+		for _, e := range current {
+			if getEnv(desired, e.Name) == nil {
+				env = append(env, e)
+			}
+		}
+		return env, nil
+	case EnvPolicyAdd:
+		env := append([]*portainer.Env{}, current...)
+		for _, e := range desired {
+			if getEnv(current, e.Name) == nil {
+				env = append(env, e)
+			}
+		}
+		return env, nil
+	}
+
+	return nil, fmt.Errorf("Unknown environment policy \"%s\"", policy)
+}
+
+func getEnv(env []*portainer.Env, name string) *portainer.Env {
+	for _, e := range env {
+		if e.Name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+func setEnv(env []*portainer.Env, name, value string) []*portainer.Env {
+	if e := getEnv(env, name); e != nil {
+		e.Value = value
+		return env
+	}
+	return append(env, &portainer.Env{Name: name, Value: value})
+}
+
+// lookupEnv resolves variables from the already parsed entries, then the process
+// environment variables exposed by envExposed.
+func lookupEnv(env []*portainer.Env, secrets []string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		if e := getEnv(env, name); e != nil {
+			return e.Value, true
+		}
+		if !envExposed(secrets, name) {
+			return "", false
+		}
+		return os.LookupEnv(name)
+	}
+}
+
+// parseDotenv parses an env file. Values may be single or double quoted and span
+// several lines. ${VAR}, ${VAR:-default} and $VAR are expanded in unquoted and
+// double quoted values from earlier entries and lookup.
+func parseDotenv(file, data string, lookup func(string) (string, bool)) ([]*portainer.Env, error) {
+	var env []*portainer.Env
+
+	expand := func(s string) string {
+		return os.Expand(s, func(name string) string {
+			if name == "$" {
+				return "$"
+			}
+
+			var def string
+			if i := strings.Index(name, ":-"); i >= 0 {
+				name, def = name[:i], name[i+2:]
+			}
+
+			if e := getEnv(env, name); e != nil && e.Value != "" {
+				return e.Value
+			}
+			if v, ok := lookup(name); ok && v != "" {
+				return v
+			}
+			return def
+		})
+	}
+
+	lines := strings.Split(strings.Replace(data, "\r\n", "\n", -1), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		start := i + 1
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("%s:%d: missing \"=\" in \"%s\"", file, start, line)
+		}
+
+		name := strings.TrimSpace(line[:eq])
+		if !envName.MatchString(name) {
+			return nil, fmt.Errorf("%s:%d: invalid variable name \"%s\"", file, start, name)
+		}
+
+		value := strings.TrimLeft(line[eq+1:], " \t")
+		if value == "" || (value[0] != '"' && value[0] != '\'') {
+			if c := strings.Index(value, " #"); c >= 0 {
+				value = value[:c]
+			}
+			env = setEnv(env, name, expand(strings.TrimSpace(value)))
+			continue
+		}
+
+		quote := value[0]
+		value = value[1:]
+
+		// collect lines until the closing quote
+		var end int
+		for {
+			end = closingQuote(value, quote)
+			if end >= 0 {
+				break
+			}
+			if i+1 >= len(lines) {
+				return nil, fmt.Errorf("%s:%d: unterminated quoted value of \"%s\"", file, start, name)
+			}
+			i++
+			value += "\n" + lines[i]
+		}
+
+		rest := strings.TrimSpace(value[end+1:])
+		if rest != "" && !strings.HasPrefix(rest, "#") {
+			return nil, fmt.Errorf("%s:%d: unexpected \"%s\" after quoted value of \"%s\"", file, i+1, rest, name)
+		}
+		value = value[:end]
+
+		if quote == '"' {
+			value = expand(unescape(value))
+		}
+		env = setEnv(env, name, value)
+	}
+
+	return env, nil
+}
+
+// closingQuote returns the index of the unescaped closing quote in s, or -1.
+func closingQuote(s string, quote byte) int {
+	for i := 0; i < len(s); i++ {
+		if quote == '"' && s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] == quote {
+			return i
+		}
+	}
+	return -1
+}
+
+// unescape resolves backslash escapes of double quoted values; \$ is kept for expand.
+func unescape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case '$':
+			b.WriteString("$$")
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/maniack/drone-portainer/lib/portainer"
+)
+
+func TestParseDotenv(t *testing.T) {
+	lookup := func(name string) (string, bool) {
+		if name == "DRONE_BRANCH" {
+			return "main", true
+		}
+		return "", false
+	}
+
+	tests := []struct {
+		name string
+		data string
+		want []string
+		err  bool
+	}{
+		{"plain", "A=1\nB = 2\n", []string{"A=1", "B=2"}, false},
+		{"comments and export", "# comment\n\nexport A=1 # inline\nB=x#y\n", []string{"A=1", "B=x#y"}, false},
+		{"crlf", "A=1\r\nB=2\r\n", []string{"A=1", "B=2"}, false},
+		{"redefined", "A=1\nA=2\n", []string{"A=2"}, false},
+		{"single quoted", "A='${B} \\n # x'\n", []string{"A=${B} \\n # x"}, false},
+		{"double quoted", "A=\"a\\tb\\n\\\"c\\\"\" # comment\n", []string{"A=a\tb\n\"c\""}, false},
+		{"multi-line", "A=\"line1\nline2\"\nB='x\ny'\n", []string{"A=line1\nline2", "B=x\ny"}, false},
+		{"earlier entries", "A=1\nB=${A}2\nC=\"$A-${B}\"\n", []string{"A=1", "B=12", "C=1-12"}, false},
+		{"lookup", "A=${DRONE_BRANCH}\n", []string{"A=main"}, false},
+		{"defaults", "A=${UNSET:-x}\nB=${DRONE_BRANCH:-x}\n", []string{"A=x", "B=main"}, false},
+		{"unset", "A=${UNSET}\n", []string{"A="}, false},
+		{"escaped dollar", "A=$$B\nB=\"\\$A\"\n", []string{"A=$B", "B=$A"}, false},
+		{"missing equals", "A\n", nil, true},
+		{"invalid name", "1A=1\n", nil, true},
+		{"unterminated", "A=\"x\nB=1\n", nil, true},
+		{"text after quote", "A=\"x\" y\n", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env, err := parseDotenv(".env", tt.data, lookup)
+			if (err != nil) != tt.err {
+				t.Fatalf("parseDotenv() error = %v, want error %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+
+			var got []string
+			for _, e := range env {
+				got = append(got, e.Name+"="+e.Value)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDotenv() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Env files can not read the plugin settings from the process environment.
+func TestLookupEnvExposed(t *testing.T) {
+	t.Setenv("PLUGIN_PORTAINER_PASSWORD", "secret")
+	t.Setenv("DRONE_BRANCH", "main")
+	t.Setenv("DB_PASSWORD", "db")
+
+	lookup := lookupEnv([]*portainer.Env{{Name: "A", Value: "1"}}, []string{"DB_*:DATABASE_PASSWORD"})
+	for name, want := range map[string]string{
+		"A":                         "1",
+		"DRONE_BRANCH":              "main",
+		"DB_PASSWORD":               "db",
+		"PLUGIN_PORTAINER_PASSWORD": "",
+	} {
+		if got, _ := lookup(name); got != want {
+			t.Errorf("lookup(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+// Secrets are read by name, renamed with SRC:DEST or selected with a glob.
+func TestSecretEnv(t *testing.T) {
+	t.Setenv("DB_PASSWORD", "db")
+	t.Setenv("DB_USER", "admin")
+	t.Setenv("API_TOKEN", "token")
+	t.Setenv("EMPTY", "")
+
+	tests := []struct {
+		secrets []string
+		want    []*portainer.Env
+		err     bool
+	}{
+		{nil, nil, false},
+		{[]string{"API_TOKEN", "EMPTY"}, []*portainer.Env{{Name: "API_TOKEN", Value: "token"}, {Name: "EMPTY", Value: ""}}, false},
+		{[]string{"API_TOKEN:TOKEN"}, []*portainer.Env{{Name: "TOKEN", Value: "token"}}, false},
+		{[]string{"DB_*"}, []*portainer.Env{{Name: "DB_PASSWORD", Value: "db"}, {Name: "DB_USER", Value: "admin"}}, false},
+		{[]string{"DB_?SER", "API_TOKEN:DB_USER"}, []*portainer.Env{{Name: "DB_USER", Value: "token"}}, false},
+		{[]string{"MISSING"}, nil, true},
+		{[]string{"API-TOKEN"}, nil, true},
+		{[]string{"API_TOKEN:"}, nil, true},
+		{[]string{":TOKEN"}, nil, true},
+		{[]string{"DB_*:DATABASE"}, nil, true},
+		{[]string{"DB_[*"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := secretEnv(tt.secrets)
+		if (err != nil) != tt.err {
+			t.Errorf("secretEnv(%q) error = %v, want error %v", tt.secrets, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("secretEnv(%q) = %s, want %s", tt.secrets, envString(got), envString(tt.want))
+		}
+	}
+}
+
+// An invalid secret fails the logger instead of leaving the secrets unmasked.
+func TestLoggerInvalidSecret(t *testing.T) {
+	p := Plugin{Config: Config{Secrets: []string{"DB_[*"}}}
+	if _, err := p.Logger(io.Discard); err == nil {
+		t.Error("Logger() error = nil for an invalid secret pattern")
+	}
+}
+
+func envString(env []*portainer.Env) string {
+	var s []string
+	for _, e := range env {
+		s = append(s, e.Name+"="+e.Value)
+	}
+	return "[" + strings.Join(s, " ") + "]"
+}
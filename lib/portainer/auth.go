@@ -0,0 +1,101 @@
+package portainer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Authenticator is a credential strategy used to sign every API request.
+type Authenticator interface {
+	// Login obtains the credentials from the server if the strategy needs it.
+	Login(p *Portainer) error
+	// Authorize adds the credentials to the request.
+	Authorize(req *http.Request)
+}
+
+// ContextAuthenticator is an Authenticator whose login can be cancelled.
+type ContextAuthenticator interface {
+	Authenticator
+	LoginContext(ctx context.Context, p *Portainer) error
+}
+
+// APIKeyAuth authenticates with a Portainer access token sent in the X-API-Key header.
+type APIKeyAuth struct {
+	Key string
+}
+
+func (self *APIKeyAuth) Login(p *Portainer) error {
+	if self.Key == "" {
+		return fmt.Errorf("Portainer API key not defined")
+	}
+
+	return nil
+}
+
+func (self *APIKeyAuth) Authorize(req *http.Request) {
+	req.Header.Set("X-API-Key", self.Key)
+}
+
+// TokenAuth authenticates with a pre-issued JWT sent as a bearer token.
+type TokenAuth struct {
+	JWT string
+}
+
+func (self *TokenAuth) Login(p *Portainer) error {
+	if self.JWT == "" {
+		return fmt.Errorf("Portainer JWT not defined")
+	}
+
+	return nil
+}
+
+func (self *TokenAuth) Authorize(req *http.Request) {
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", self.JWT))
+}
+
+// PasswordAuth logs in with a username and password and keeps the issued JWT.
+type PasswordAuth struct {
+	Username string
+	Password string
+
+	jwt string
+}
+
+func (self *PasswordAuth) Login(p *Portainer) error {
+	return self.LoginContext(context.Background(), p)
+}
+
+func (self *PasswordAuth) LoginContext(ctx context.Context, p *Portainer) error {
+	r, err := newRequest("POST", fmt.Sprintf("%s/api/auth", p.address), &struct {
+		Username string `json:"Username"`
+		Password string `json:"Password"`
+	}{
+		Username: self.Username,
+		Password: self.Password,
+	})
+	if err != nil {
+		return err
+	}
+	// logging in again is harmless
+	r.idempotent = true
+
+	var auth struct {
+		JWT string `json:"jwt"`
+	}
+
+	if err := p.send(ctx, r, &auth); err != nil {
+		return err
+	}
+	if auth.JWT == "" {
+		return fmt.Errorf("Authentication response without token")
+	}
+
+	self.jwt = auth.JWT
+
+	return nil
+}
+
+func (self *PasswordAuth) Authorize(req *http.Request) {
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", self.jwt))
+}
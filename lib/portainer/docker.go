@@ -0,0 +1,512 @@
+package portainer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	StackNamespaceLabel = "com.docker.stack.namespace"
+	ComposeProjectLabel = "com.docker.compose.project"
+	ComposeServiceLabel = "com.docker.compose.service"
+	ComposeOneoffLabel  = "com.docker.compose.oneoff"
+	ComposeConfigLabel  = "com.docker.compose.config-hash"
+)
+
+type Service struct {
+	ID      string `json:"ID"`
+	Version struct {
+		Index uint64 `json:"Index"`
+	} `json:"Version"`
+	UpdatedAt time.Time `json:"UpdatedAt"`
+	Spec      struct {
+		Name         string          `json:"Name"`
+		TaskTemplate json.RawMessage `json:"TaskTemplate"`
+		Mode         struct {
+			Replicated *struct {
+				Replicas *uint64 `json:"Replicas"`
+			} `json:"Replicated,omitempty"`
+			Global *struct{} `json:"Global,omitempty"`
+		} `json:"Mode"`
+	} `json:"Spec"`
+	UpdateStatus *struct {
+		State     string     `json:"State"`
+		StartedAt *time.Time `json:"StartedAt"`
+		Message   string     `json:"Message"`
+	} `json:"UpdateStatus,omitempty"`
+}
+
+type Task struct {
+	ID           string          `json:"ID"`
+	ServiceID    string          `json:"ServiceID"`
+	NodeID       string          `json:"NodeID"`
+	DesiredState string          `json:"DesiredState"`
+	Spec         json.RawMessage `json:"Spec"`
+	Status       struct {
+		State   string `json:"State"`
+		Message string `json:"Message"`
+		Err     string `json:"Err"`
+	} `json:"Status"`
+}
+
+type Container struct {
+	Id      string            `json:"Id"`
+	Names   []string          `json:"Names"`
+	State   string            `json:"State"`
+	Status  string            `json:"Status"`
+	Created int64             `json:"Created"`
+	Labels  map[string]string `json:"Labels"`
+}
+
+type Volume struct {
+	Name   string            `json:"Name"`
+	Driver string            `json:"Driver"`
+	Labels map[string]string `json:"Labels"`
+}
+
+type Network struct {
+	Id     string            `json:"Id"`
+	Name   string            `json:"Name"`
+	Driver string            `json:"Driver"`
+	Labels map[string]string `json:"Labels"`
+}
+
+// ServiceStatus is the rollout state of a single stack service.
+type ServiceStatus struct {
+	Name    string
+	Desired int
+	Running int
+	Update  string
+	Error   string
+}
+
+func (self *ServiceStatus) Converged() bool {
+	if self.Running < self.Desired {
+		return false
+	}
+
+	switch self.Update {
+	case "", "completed":
+		return true
+	}
+
+	return false
+}
+
+// Failed reports whether swarm gave up the update of the service, which
+// will not converge without another deploy.
+func (self *ServiceStatus) Failed() bool {
+	switch self.Update {
+	case "paused", "rollback_started", "rollback_paused", "rollback_completed":
+		return true
+	}
+
+	return false
+}
+
+func (self *ServiceStatus) String() string {
+	s := fmt.Sprintf("%s: %d/%d running", self.Name, self.Running, self.Desired)
+	if self.Update != "" {
+		s += fmt.Sprintf(", update %s", self.Update)
+	}
+	if self.Error != "" {
+		s += fmt.Sprintf(" (%s)", self.Error)
+	}
+	return s
+}
+
+func (self *Portainer) docker(ctx context.Context, endpoint *Endpoint, path string, filters map[string][]string, v interface{}) error {
+	if len(filters) > 0 {
+		args, err := json.Marshal(filters)
+		if err != nil {
+			return err
+		}
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		path += sep + "filters=" + url.QueryEscape(string(args))
+	}
+
+	return self.dockerDo(ctx, endpoint, "GET", path, nil, v)
+}
+
+// dockerDo sends a request to the Docker API of the endpoint through the Portainer proxy.
+func (self *Portainer) dockerDo(ctx context.Context, endpoint *Endpoint, method string, path string, body interface{}, v interface{}) error {
+	return self.api(ctx, method, fmt.Sprintf("endpoints/%d/docker/%s", endpoint.Id, path), body, v)
+}
+
+// GetSwarmID returns the swarm cluster ID of the endpoint, or an empty string
+// if the Docker engine is not a swarm manager.
+func (self *Portainer) GetSwarmID(endpoint *Endpoint) (string, error) {
+	return self.GetSwarmIDContext(context.Background(), endpoint)
+}
+
+func (self *Portainer) GetSwarmIDContext(ctx context.Context, endpoint *Endpoint) (string, error) {
+	var info struct {
+		Swarm struct {
+			LocalNodeState   string `json:"LocalNodeState"`
+			ControlAvailable bool   `json:"ControlAvailable"`
+			Cluster          *struct {
+				ID string `json:"ID"`
+			} `json:"Cluster"`
+		} `json:"Swarm"`
+	}
+
+	err := self.docker(ctx, endpoint, "info", nil, &info)
+	if err != nil {
+		return "", err
+	}
+
+	if info.Swarm.LocalNodeState != "active" || !info.Swarm.ControlAvailable || info.Swarm.Cluster == nil {
+		return "", nil
+	}
+
+	return info.Swarm.Cluster.ID, nil
+}
+
+func (self *Portainer) GetStackServices(endpoint *Endpoint, name string) ([]*Service, error) {
+	return self.GetStackServicesContext(context.Background(), endpoint, name)
+}
+
+func (self *Portainer) GetStackServicesContext(ctx context.Context, endpoint *Endpoint, name string) ([]*Service, error) {
+	var services []*Service
+
+	err := self.docker(ctx, endpoint, "services", map[string][]string{
+		"label": {fmt.Sprintf("%s=%s", StackNamespaceLabel, name)},
+	}, &services)
+	if err != nil {
+		return nil, err
+	}
+
+	return services, nil
+}
+
+func (self *Portainer) GetStackTasks(endpoint *Endpoint, name string) ([]*Task, error) {
+	return self.GetStackTasksContext(context.Background(), endpoint, name)
+}
+
+func (self *Portainer) GetStackTasksContext(ctx context.Context, endpoint *Endpoint, name string) ([]*Task, error) {
+	var tasks []*Task
+
+	err := self.docker(ctx, endpoint, "tasks", map[string][]string{
+		"label": {fmt.Sprintf("%s=%s", StackNamespaceLabel, name)},
+	}, &tasks)
+	if err != nil {
+		return nil, err
+	}
+
+	return tasks, nil
+}
+
+func (self *Portainer) GetStackContainers(endpoint *Endpoint, name string) ([]*Container, error) {
+	return self.GetStackContainersContext(context.Background(), endpoint, name)
+}
+
+func (self *Portainer) GetStackContainersContext(ctx context.Context, endpoint *Endpoint, name string) ([]*Container, error) {
+	var containers []*Container
+
+	err := self.docker(ctx, endpoint, "containers/json?all=1", map[string][]string{
+		"label": {fmt.Sprintf("%s=%s", ComposeProjectLabel, name)},
+	}, &containers)
+	if err != nil {
+		return nil, err
+	}
+
+	return containers, nil
+}
+
+// stackLabel is the label Docker puts on the resources of a stack of the endpoint's stack type.
+func stackLabel(endpoint *Endpoint, name string) string {
+	if endpoint.stackType() == StackTypeSwarm {
+		return fmt.Sprintf("%s=%s", StackNamespaceLabel, name)
+	}
+	return fmt.Sprintf("%s=%s", ComposeProjectLabel, name)
+}
+
+func (self *Portainer) GetStackVolumes(endpoint *Endpoint, name string) ([]*Volume, error) {
+	return self.GetStackVolumesContext(context.Background(), endpoint, name)
+}
+
+func (self *Portainer) GetStackVolumesContext(ctx context.Context, endpoint *Endpoint, name string) ([]*Volume, error) {
+	var volumes struct {
+		Volumes []*Volume `json:"Volumes"`
+	}
+
+	err := self.docker(ctx, endpoint, "volumes", map[string][]string{
+		"label": {stackLabel(endpoint, name)},
+	}, &volumes)
+	if err != nil {
+		return nil, err
+	}
+
+	return volumes.Volumes, nil
+}
+
+func (self *Portainer) DeleteVolume(endpoint *Endpoint, name string) error {
+	return self.DeleteVolumeContext(context.Background(), endpoint, name)
+}
+
+func (self *Portainer) DeleteVolumeContext(ctx context.Context, endpoint *Endpoint, name string) error {
+	return self.dockerDo(ctx, endpoint, "DELETE", fmt.Sprintf("volumes/%s", url.PathEscape(name)), nil, nil)
+}
+
+func (self *Portainer) GetStackNetworks(endpoint *Endpoint, name string) ([]*Network, error) {
+	return self.GetStackNetworksContext(context.Background(), endpoint, name)
+}
+
+func (self *Portainer) GetStackNetworksContext(ctx context.Context, endpoint *Endpoint, name string) ([]*Network, error) {
+	var networks []*Network
+
+	err := self.docker(ctx, endpoint, "networks", map[string][]string{
+		"label": {stackLabel(endpoint, name)},
+	}, &networks)
+	if err != nil {
+		return nil, err
+	}
+
+	return networks, nil
+}
+
+func (self *Portainer) DeleteNetwork(endpoint *Endpoint, id string) error {
+	return self.DeleteNetworkContext(context.Background(), endpoint, id)
+}
+
+func (self *Portainer) DeleteNetworkContext(ctx context.Context, endpoint *Endpoint, id string) error {
+	return self.dockerDo(ctx, endpoint, "DELETE", fmt.Sprintf("networks/%s", url.PathEscape(id)), nil, nil)
+}
+
+// GetStackStatus reports the rollout state of every service in the stack. The
+// services of a swarm stack as they were before a deploy, if given, tell the
+// update status of that deploy from the status of an earlier one.
+func (self *Portainer) GetStackStatus(endpoint *Endpoint, name string, previous []*Service) ([]*ServiceStatus, error) {
+	return self.GetStackStatusContext(context.Background(), endpoint, name, previous)
+}
+
+func (self *Portainer) GetStackStatusContext(ctx context.Context, endpoint *Endpoint, name string, previous []*Service) ([]*ServiceStatus, error) {
+	var (
+		statuses []*ServiceStatus
+		err      error
+	)
+
+	switch endpoint.stackType() {
+	case StackTypeSwarm:
+		statuses, err = self.getSwarmStackStatus(ctx, endpoint, name, previous)
+	case StackTypeCompose:
+		statuses, err = self.getComposeStackStatus(ctx, endpoint, name)
+	default:
+		return nil, fmt.Errorf("Stack status not supported on endpoint \"%s\"", endpoint.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	return statuses, nil
+}
+
+// getComposeStackStatus counts the running containers of each service. One-off
+// containers, containers which exited successfully and containers of an older
+// configuration of the service, which compose has not replaced yet, are not counted.
+func (self *Portainer) getComposeStackStatus(ctx context.Context, endpoint *Endpoint, name string) ([]*ServiceStatus, error) {
+	containers, err := self.GetStackContainersContext(ctx, endpoint, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// the newest container of a service runs its current configuration
+	current := map[string]*Container{}
+	for _, container := range containers {
+		service := container.Labels[ComposeServiceLabel]
+		if container.Labels[ComposeOneoffLabel] == "True" {
+			continue
+		}
+		if c, ok := current[service]; !ok || container.Created > c.Created {
+			current[service] = container
+		}
+	}
+
+	var statuses []*ServiceStatus
+	index := map[string]*ServiceStatus{}
+	for _, container := range containers {
+		service := container.Labels[ComposeServiceLabel]
+		if container.Labels[ComposeOneoffLabel] == "True" {
+			continue
+		}
+
+		status, ok := index[service]
+		if !ok {
+			status = &ServiceStatus{Name: service}
+			index[service] = status
+			statuses = append(statuses, status)
+		}
+
+		if container.Labels[ComposeConfigLabel] != current[service].Labels[ComposeConfigLabel] {
+			continue
+		}
+		if container.State == "exited" && strings.HasPrefix(container.Status, "Exited (0)") {
+			continue
+		}
+
+		status.Desired++
+		if container.State == "running" && !strings.Contains(container.Status, "(unhealthy)") && !strings.Contains(container.Status, "(health: starting)") {
+			status.Running++
+		} else {
+			status.Error = container.Status
+		}
+	}
+
+	return statuses, nil
+}
+
+// getSwarmStackStatus counts the running tasks of each service. Tasks of an
+// older service spec, which swarm has not replaced yet, are not counted.
+func (self *Portainer) getSwarmStackStatus(ctx context.Context, endpoint *Endpoint, name string, previous []*Service) ([]*ServiceStatus, error) {
+	services, err := self.GetStackServicesContext(ctx, endpoint, name)
+	if err != nil {
+		return nil, err
+	}
+
+	tasks, err := self.GetStackTasksContext(ctx, endpoint, name)
+	if err != nil {
+		return nil, err
+	}
+
+	before := map[string]*Service{}
+	for _, service := range previous {
+		before[service.ID] = service
+	}
+
+	var statuses []*ServiceStatus
+	for _, service := range services {
+		status := &ServiceStatus{Name: service.Spec.Name}
+
+		if r := service.Spec.Mode.Replicated; r != nil && r.Replicas != nil {
+			status.Desired = int(*r.Replicas)
+		}
+		if service.UpdateStatus != nil && !staleUpdate(service, before[service.ID]) {
+			status.Update = service.UpdateStatus.State
+			status.Error = service.UpdateStatus.Message
+		}
+
+		for _, task := range tasks {
+			if task.ServiceID != service.ID {
+				continue
+			}
+			if service.Spec.Mode.Global != nil && task.DesiredState == "running" {
+				status.Desired++
+			}
+			if !sameTaskSpec(service.Spec.TaskTemplate, task.Spec) {
+				continue
+			}
+			if task.DesiredState == "running" && task.Status.State == "running" {
+				status.Running++
+			} else if task.Status.Err != "" {
+				status.Error = task.Status.Err
+			}
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// staleUpdate reports whether the update status of the service is left from
+// before the deploy, which did not change the service or has not started its
+// update yet.
+func staleUpdate(service *Service, before *Service) bool {
+	if before == nil {
+		return false
+	}
+	if service.Version.Index == before.Version.Index {
+		return true
+	}
+
+	started := service.UpdateStatus.StartedAt
+	return started == nil || !started.After(before.UpdatedAt)
+}
+
+// sameTaskSpec reports whether a task runs the task template of its service.
+// Placement is ignored like swarm does, it does not replace tasks for it.
+func sameTaskSpec(template, spec json.RawMessage) bool {
+	var a, b map[string]interface{}
+	if json.Unmarshal(template, &a) != nil || json.Unmarshal(spec, &b) != nil {
+		return true
+	}
+	delete(a, "Placement")
+	delete(b, "Placement")
+
+	return reflect.DeepEqual(a, b)
+}
+
+// WaitStack polls the stack services until all of them converge or the timeout expires.
+// previous are the services of a swarm stack before the deploy, see GetStackStatus.
+// The stack has to stay converged for two polls in a row, so that a task which
+// crashes right after starting is not taken for a rollout. A service whose update
+// swarm paused or rolled back fails the wait at once.
+func (self *Portainer) WaitStack(endpoint *Endpoint, name string, previous []*Service, timeout, interval time.Duration) error {
+	return self.WaitStackContext(context.Background(), endpoint, name, previous, timeout, interval)
+}
+
+func (self *Portainer) WaitStackContext(ctx context.Context, endpoint *Endpoint, name string, previous []*Service, timeout, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("Wait interval must be positive, got %s", interval)
+	}
+
+	deadline := time.Now().Add(timeout)
+	converged := false
+
+	for {
+		statuses, err := self.GetStackStatusContext(ctx, endpoint, name, previous)
+		if err != nil {
+			return err
+		}
+
+		var pending, failed []string
+		for _, status := range statuses {
+			if status.Failed() {
+				failed = append(failed, status.String())
+			}
+			if !status.Converged() {
+				pending = append(pending, status.String())
+			}
+		}
+
+		if len(failed) > 0 {
+			return fmt.Errorf("Stack \"%s\" update failed:\n  %s", name, strings.Join(failed, "\n  "))
+		}
+
+		if len(statuses) > 0 && len(pending) == 0 {
+			if converged {
+				return nil
+			}
+			converged = true
+		} else {
+			converged = false
+		}
+
+		if time.Now().After(deadline) {
+			if converged {
+				return nil
+			}
+			if len(statuses) == 0 {
+				return fmt.Errorf("Stack \"%s\" has no services after %s", name, timeout)
+			}
+			return fmt.Errorf("Stack \"%s\" did not converge in %s:\n  %s", name, timeout, strings.Join(pending, "\n  "))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
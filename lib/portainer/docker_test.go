@@ -0,0 +1,158 @@
+package portainer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dockerServer serves the Docker API responses of endpoint 1 by path.
+func dockerServer(t *testing.T, responses map[string]string) *Portainer {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := responses[strings.TrimPrefix(r.URL.Path, "/api/endpoints/1/docker/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	prtnr, err := NewPortainer(srv.URL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prtnr
+}
+
+func statusStrings(statuses []*ServiceStatus) []string {
+	var s []string
+	for _, status := range statuses {
+		s = append(s, status.String())
+	}
+	return s
+}
+
+// One-off containers, containers which exited successfully and containers of an
+// older configuration do not count for the service.
+func TestComposeStackStatus(t *testing.T) {
+	prtnr := dockerServer(t, map[string]string{"containers/json": `[
+		{"State":"running","Status":"Up 1 hour","Created":1,"Labels":{"com.docker.compose.service":"web","com.docker.compose.config-hash":"old"}},
+		{"State":"running","Status":"Up 2 seconds","Created":2,"Labels":{"com.docker.compose.service":"web","com.docker.compose.config-hash":"new"}},
+		{"State":"exited","Status":"Exited (1) 1 second ago","Created":3,"Labels":{"com.docker.compose.service":"web","com.docker.compose.oneoff":"True"}},
+		{"State":"exited","Status":"Exited (0) 2 seconds ago","Created":1,"Labels":{"com.docker.compose.service":"init","com.docker.compose.config-hash":"a"}},
+		{"State":"exited","Status":"Exited (1) 2 seconds ago","Created":1,"Labels":{"com.docker.compose.service":"worker","com.docker.compose.config-hash":"a"}},
+		{"State":"running","Status":"Up 2 seconds (health: starting)","Created":1,"Labels":{"com.docker.compose.service":"db","com.docker.compose.config-hash":"a"}}
+	]`})
+	endpoint := &Endpoint{Id: 1, Name: "local", StackType: StackTypeCompose}
+
+	statuses, err := prtnr.GetStackStatus(endpoint, "app", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"db: 0/1 running (Up 2 seconds (health: starting))",
+		"init: 0/0 running",
+		"web: 1/1 running",
+		"worker: 0/1 running (Exited (1) 2 seconds ago)",
+	}
+	if got := statusStrings(statuses); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("GetStackStatus() = %q, want %q", got, want)
+	}
+}
+
+// Tasks of an older spec are not counted, placement changes do not make a spec older,
+// and update states left from before the deploy are ignored.
+func TestSwarmStackStatus(t *testing.T) {
+	prtnr := dockerServer(t, map[string]string{
+		"services": `[
+			{"ID":"web","Version":{"Index":5},"Spec":{"Name":"app_web","TaskTemplate":{"ContainerSpec":{"Image":"web:2"}},"Mode":{"Replicated":{"Replicas":2}}}},
+			{"ID":"api","Version":{"Index":7},"Spec":{"Name":"app_api","TaskTemplate":{"ContainerSpec":{"Image":"api:2"}},"Mode":{"Replicated":{"Replicas":1}}},
+				"UpdateStatus":{"State":"paused","StartedAt":"2026-01-01T10:00:00Z","Message":"update paused due to failure"}},
+			{"ID":"cron","Version":{"Index":3},"Spec":{"Name":"app_cron","TaskTemplate":{"ContainerSpec":{"Image":"cron:1"}},"Mode":{"Replicated":{"Replicas":1}}},
+				"UpdateStatus":{"State":"rollback_completed","StartedAt":"2025-12-01T10:00:00Z"}},
+			{"ID":"agent","Version":{"Index":2},"Spec":{"Name":"app_agent","TaskTemplate":{"ContainerSpec":{"Image":"agent:1"}},"Mode":{"Global":{}}}}
+		]`,
+		"tasks": `[
+			{"ServiceID":"web","DesiredState":"running","Spec":{"ContainerSpec":{"Image":"web:2"}},"Status":{"State":"running"}},
+			{"ServiceID":"web","DesiredState":"running","Spec":{"ContainerSpec":{"Image":"web:2"},"Placement":{"Constraints":["node.role==worker"]}},"Status":{"State":"running"}},
+			{"ServiceID":"web","DesiredState":"shutdown","Spec":{"ContainerSpec":{"Image":"web:1"}},"Status":{"State":"running"}},
+			{"ServiceID":"api","DesiredState":"running","Spec":{"ContainerSpec":{"Image":"api:2"}},"Status":{"State":"failed","Err":"task: non-zero exit (1)"}},
+			{"ServiceID":"cron","DesiredState":"running","Spec":{"ContainerSpec":{"Image":"cron:1"}},"Status":{"State":"running"}},
+			{"ServiceID":"agent","DesiredState":"running","Spec":{"ContainerSpec":{"Image":"agent:1"}},"Status":{"State":"running"}},
+			{"ServiceID":"agent","DesiredState":"running","Spec":{"ContainerSpec":{"Image":"agent:1"}},"Status":{"State":"starting"}}
+		]`,
+	})
+	endpoint := &Endpoint{Id: 1, Name: "swarm", SwarmID: "cluster", StackType: StackTypeSwarm}
+
+	cron := &Service{ID: "cron"}
+	cron.Version.Index = 3
+	api := &Service{ID: "api", UpdatedAt: time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)}
+	api.Version.Index = 6
+
+	statuses, err := prtnr.GetStackStatus(endpoint, "app", []*Service{cron, api})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"app_agent: 1/2 running",
+		"app_api: 0/1 running, update paused (task: non-zero exit (1))",
+		"app_cron: 1/1 running",
+		"app_web: 2/2 running",
+	}
+	if got := statusStrings(statuses); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("GetStackStatus() = %q, want %q", got, want)
+	}
+
+	for _, status := range statuses {
+		if failed := status.Name == "app_api"; status.Failed() != failed {
+			t.Errorf("%s Failed() = %v, want %v", status.Name, status.Failed(), failed)
+		}
+	}
+}
+
+// A paused update fails the wait at once, a converged stack ends it and
+// a non-positive interval is refused instead of polling in a tight loop.
+func TestWaitStack(t *testing.T) {
+	paused := dockerServer(t, map[string]string{
+		"services": `[{"ID":"api","Spec":{"Name":"app_api","Mode":{"Replicated":{"Replicas":1}}},"UpdateStatus":{"State":"paused"}}]`,
+		"tasks":    `[]`,
+	})
+	converged := dockerServer(t, map[string]string{
+		"containers/json": `[{"State":"running","Status":"Up 1 second","Labels":{"com.docker.compose.service":"web"}}]`,
+	})
+	pending := dockerServer(t, map[string]string{
+		"containers/json": `[{"State":"restarting","Status":"Restarting (1) 1 second ago","Labels":{"com.docker.compose.service":"web"}}]`,
+	})
+	swarm := &Endpoint{Id: 1, SwarmID: "cluster", StackType: StackTypeSwarm}
+	compose := &Endpoint{Id: 1, StackType: StackTypeCompose}
+
+	tests := []struct {
+		name     string
+		prtnr    *Portainer
+		endpoint *Endpoint
+		timeout  time.Duration
+		interval time.Duration
+		err      string
+	}{
+		{"paused", paused, swarm, time.Minute, time.Millisecond, "update failed"},
+		{"converged", converged, compose, time.Minute, time.Millisecond, ""},
+		{"pending", pending, compose, 20 * time.Millisecond, time.Millisecond, "did not converge"},
+		{"zero interval", converged, compose, time.Minute, 0, "interval must be positive"},
+		{"negative interval", converged, compose, time.Minute, -time.Second, "interval must be positive"},
+	}
+
+	for _, tt := range tests {
+		err := tt.prtnr.WaitStack(tt.endpoint, "app", nil, tt.timeout, tt.interval)
+		if tt.err == "" && err != nil {
+			t.Errorf("WaitStack() %s error = %v", tt.name, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("WaitStack() %s error = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package portainer
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type Tag struct {
+	ID   int    `json:"ID"`
+	Name string `json:"Name"`
+}
+
+type EndpointGroup struct {
+	Id     int    `json:"Id"`
+	Name   string `json:"Name"`
+	TagIds []int  `json:"TagIds"`
+}
+
+func (self *Portainer) GetEndpoints() ([]*Endpoint, error) {
+	return self.GetEndpointsContext(context.Background())
+}
+
+func (self *Portainer) GetEndpointsContext(ctx context.Context) ([]*Endpoint, error) {
+	var endpoints []*Endpoint
+	if err := self.api(ctx, "GET", "endpoints", nil, &endpoints); err != nil {
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+// GetEndpointByID returns the endpoint with its stack type detected.
+func (self *Portainer) GetEndpointByID(id int) (*Endpoint, error) {
+	return self.GetEndpointByIDContext(context.Background(), id)
+}
+
+func (self *Portainer) GetEndpointByIDContext(ctx context.Context, id int) (*Endpoint, error) {
+	var endpoint Endpoint
+	if err := self.api(ctx, "GET", fmt.Sprintf("endpoints/%d", id), nil, &endpoint); err != nil {
+		return nil, err
+	}
+
+	if err := self.detectStackType(ctx, &endpoint); err != nil {
+		return nil, err
+	}
+
+	return &endpoint, nil
+}
+
+func (self *Portainer) GetTags() ([]*Tag, error) {
+	return self.GetTagsContext(context.Background())
+}
+
+func (self *Portainer) GetTagsContext(ctx context.Context) ([]*Tag, error) {
+	var tags []*Tag
+	if err := self.api(ctx, "GET", "tags", nil, &tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func (self *Portainer) GetEndpointGroups() ([]*EndpointGroup, error) {
+	return self.GetEndpointGroupsContext(context.Background())
+}
+
+func (self *Portainer) GetEndpointGroupsContext(ctx context.Context) ([]*EndpointGroup, error) {
+	var groups []*EndpointGroup
+	if err := self.api(ctx, "GET", "endpoint_groups", nil, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// detectStackType sets the swarm ID and the type of stacks created on the endpoint.
+func (self *Portainer) detectStackType(ctx context.Context, endpoint *Endpoint) error {
+	if endpoint.IsKubernetes() {
+		endpoint.StackType = StackTypeKubernetes
+		return nil
+	}
+
+	swarmID, err := self.GetSwarmIDContext(ctx, endpoint)
+	if err != nil {
+		return err
+	}
+
+	endpoint.SwarmID = swarmID
+	endpoint.StackType = StackTypeCompose
+	if swarmID != "" {
+		endpoint.StackType = StackTypeSwarm
+	}
+
+	return nil
+}
+
+// FindEndpoints returns the endpoints matching a selector.
+// A selector is an endpoint name, a name glob, or one of
+//
+//	id:<id>        endpoint ID, also accepted as a plain number
+//	name:<glob>    name glob
+//	regex:<expr>   name regular expression
+//	tag:<name>     endpoints tagged directly or through their group
+//	group:<name>   endpoints of the endpoint group
+//	url:<glob>     endpoint URL or public URL glob
+//
+// The stack type of the returned endpoints is not detected.
+func (self *Portainer) FindEndpoints(selector string) ([]*Endpoint, error) {
+	return self.FindEndpointsContext(context.Background(), selector)
+}
+
+func (self *Portainer) FindEndpointsContext(ctx context.Context, selector string) ([]*Endpoint, error) {
+	if selector == "" {
+		return nil, fmt.Errorf("Endpoint not defined")
+	}
+
+	kind, value := "", selector
+	if i := strings.Index(selector, ":"); i > 0 {
+		switch selector[:i] {
+		case "id", "name", "regex", "tag", "group", "url":
+			kind, value = selector[:i], selector[i+1:]
+		}
+	}
+
+	endpoints, err := self.GetEndpointsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var match func(*Endpoint) (bool, error)
+	switch kind {
+	case "":
+		match = func(e *Endpoint) (bool, error) {
+			if strings.ContainsAny(value, "*?[") {
+				return path.Match(value, e.Name)
+			}
+			return e.Name == value, nil
+		}
+
+		// a plain number selects by ID unless an endpoint has that name
+		if id, err := strconv.Atoi(value); err == nil && !hasEndpointName(endpoints, value) {
+			match = func(e *Endpoint) (bool, error) { return e.Id == id, nil }
+		}
+	case "id":
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("Endpoint selector \"%s\" is invalid: %s", selector, err)
+		}
+		match = func(e *Endpoint) (bool, error) { return e.Id == id, nil }
+	case "name":
+		if _, err := path.Match(value, ""); err != nil {
+			return nil, fmt.Errorf("Endpoint selector \"%s\" is invalid: %s", selector, err)
+		}
+		match = func(e *Endpoint) (bool, error) { return path.Match(value, e.Name) }
+	case "regex":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("Endpoint selector \"%s\" is invalid: %s", selector, err)
+		}
+		match = func(e *Endpoint) (bool, error) { return re.MatchString(e.Name), nil }
+	case "url":
+		// * also matches the slashes of URLs
+		re, err := regexp.Compile("^" + strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(regexp.QuoteMeta(value)) + "$")
+		if err != nil {
+			return nil, fmt.Errorf("Endpoint selector \"%s\" is invalid: %s", selector, err)
+		}
+		match = func(e *Endpoint) (bool, error) {
+			return (e.URL != "" && re.MatchString(e.URL)) || (e.PublicURL != "" && re.MatchString(e.PublicURL)), nil
+		}
+	case "tag":
+		tags, err := self.GetTagsContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		groups, err := self.GetEndpointGroupsContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		tag := -1
+		for _, t := range tags {
+			if t.Name == value {
+				tag = t.ID
+			}
+		}
+		if tag < 0 {
+			return nil, fmt.Errorf("Tag \"%s\" not found", value)
+		}
+
+		tagged := map[int]bool{}
+		for _, g := range groups {
+			if hasTag(g.TagIds, tag) {
+				tagged[g.Id] = true
+			}
+		}
+		match = func(e *Endpoint) (bool, error) { return hasTag(e.TagIds, tag) || tagged[e.GroupId], nil }
+	case "group":
+		groups, err := self.GetEndpointGroupsContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		group := -1
+		for _, g := range groups {
+			if g.Name == value {
+				group = g.Id
+			}
+		}
+		if group < 0 {
+			return nil, fmt.Errorf("Endpoint group \"%s\" not found", value)
+		}
+		match = func(e *Endpoint) (bool, error) { return e.GroupId == group, nil }
+	}
+
+	var found []*Endpoint
+	for _, e := range endpoints {
+		ok, err := match(e)
+		if err != nil {
+			return nil, fmt.Errorf("Endpoint selector \"%s\" is invalid: %s", selector, err)
+		}
+		if ok {
+			found = append(found, e)
+		}
+	}
+
+	if len(found) == 0 {
+		return nil, fmt.Errorf("Endpoint \"%s\" not found", selector)
+	}
+
+	return found, nil
+}
+
+func hasEndpointName(endpoints []*Endpoint, name string) bool {
+	for _, e := range endpoints {
+		if e.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasTag(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package portainer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestFindEndpoints(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/endpoints":
+			w.Write([]byte(`[
+				{"Id":1,"Name":"local","URL":"unix:///var/run/docker.sock","GroupId":1},
+				{"Id":2,"Name":"prod-eu","URL":"tcp://10.0.0.2:9001","GroupId":2,"TagIds":[1]},
+				{"Id":3,"Name":"prod-us","URL":"tcp://10.0.1.3:9001","PublicURL":"us.example.com","GroupId":2},
+				{"Id":4,"Name":"2","URL":"tcp://10.0.2.4:9001","GroupId":3,"TagIds":[2]}
+			]`))
+		case "/api/tags":
+			w.Write([]byte(`[{"ID":1,"Name":"eu"},{"ID":2,"Name":"edge"},{"ID":3,"Name":"prod"}]`))
+		case "/api/endpoint_groups":
+			w.Write([]byte(`[{"Id":1,"Name":"Unassigned"},{"Id":2,"Name":"production","TagIds":[3]},{"Id":3,"Name":"edge"}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	prtnr, err := NewPortainer(srv.URL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		selector string
+		want     []int
+		err      bool
+	}{
+		{"local", []int{1}, false},
+		{"prod-*", []int{2, 3}, false},
+		{"3", []int{3}, false},
+		{"2", []int{4}, false},
+		{"id:2", []int{2}, false},
+		{"id:x", nil, true},
+		{"name:prod-?u", []int{2}, false},
+		{"name:[", nil, true},
+		{"regex:^prod-(eu|us)$", []int{2, 3}, false},
+		{"regex:(", nil, true},
+		{"tag:eu", []int{2}, false},
+		{"tag:prod", []int{2, 3}, false},
+		{"tag:missing", nil, true},
+		{"group:edge", []int{4}, false},
+		{"group:missing", nil, true},
+		{"url:tcp://10.0.*", []int{2, 3, 4}, false},
+		{"url:us.example.com", []int{3}, false},
+		{"unknown:local", nil, true},
+		{"missing", nil, true},
+		{"", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			endpoints, err := prtnr.FindEndpoints(tt.selector)
+			if (err != nil) != tt.err {
+				t.Fatalf("FindEndpoints(%q) error = %v, want error %v", tt.selector, err, tt.err)
+			}
+
+			var got []int
+			for _, e := range endpoints {
+				got = append(got, e.Id)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FindEndpoints(%q) = %v, want %v", tt.selector, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package portainer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrConflict     = errors.New("conflict")
+)
+
+// APIError is a response of the Portainer API with a non-2xx status.
+type APIError struct {
+	StatusCode int
+	Status     string
+	Method     string
+	URL        string
+	Message    string
+	Details    string
+	Body       []byte
+}
+
+func (self *APIError) Error() string {
+	s := fmt.Sprintf("Portainer API error: %s %s %s", self.Method, self.URL, self.Status)
+	if self.Message != "" {
+		s += " - " + self.Message
+	}
+	if self.Details != "" && self.Details != self.Message {
+		s += fmt.Sprintf(" (%s)", self.Details)
+	}
+	return s
+}
+
+// Is matches the sentinel error of the status code.
+func (self *APIError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return self.StatusCode == http.StatusNotFound
+	case ErrUnauthorized:
+		return self.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return self.StatusCode == http.StatusForbidden
+	case ErrConflict:
+		return self.StatusCode == http.StatusConflict
+	}
+	return false
+}
+
+// checkResponse returns an APIError for any response with a non-2xx status.
+func checkResponse(req *http.Request, rsp *http.Response) error {
+	if rsp.StatusCode >= 200 && rsp.StatusCode <= 299 {
+		return nil
+	}
+
+	err := &APIError{
+		StatusCode: rsp.StatusCode,
+		Status:     rsp.Status,
+		Method:     req.Method,
+		URL:        req.URL.String(),
+	}
+
+	err.Body, _ = ioutil.ReadAll(rsp.Body)
+
+	var body struct {
+		Message string `json:"message"`
+		Details string `json:"details"`
+		Err     string `json:"err"`
+	}
+	if json.Unmarshal(err.Body, &body) == nil {
+		err.Message, err.Details = body.Message, body.Details
+		if err.Message == "" {
+			err.Message = body.Err
+		}
+	} else if text := strings.TrimSpace(string(err.Body)); len(text) <= 200 && !strings.HasPrefix(text, "<") {
+		err.Message = text
+	}
+
+	if location := rsp.Header.Get("Location"); rsp.StatusCode >= 300 && rsp.StatusCode <= 399 && location != "" {
+		err.Details = fmt.Sprintf("redirected to %s", location)
+	}
+
+	return err
+}
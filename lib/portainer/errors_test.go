@@ -0,0 +1,115 @@
+package portainer
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// The message and details are read from JSON bodies, short plain text bodies
+// are the message and HTML pages are left out.
+func TestCheckResponse(t *testing.T) {
+	tests := []struct {
+		status   int
+		body     string
+		location string
+		message  string
+		details  string
+	}{
+		{200, `{"message":"ignored"}`, "", "", ""},
+		{204, ``, "", "", ""},
+		{404, `{"message":"Unable to find a stack","details":"object not found inside the database"}`, "", "Unable to find a stack", "object not found inside the database"},
+		{409, `{"err":"A stack with this name already exists"}`, "", "A stack with this name already exists", ""},
+		{400, `{"message":"Invalid request","err":"ignored"}`, "", "Invalid request", ""},
+		{502, "bad gateway\n", "", "bad gateway", ""},
+		{502, "<html><body>Bad Gateway</body></html>", "", "", ""},
+		{500, strings.Repeat("x", 201), "", "", ""},
+		{500, ``, "", "", ""},
+		{301, ``, "https://portainer.example.com/api/stacks", "", "redirected to https://portainer.example.com/api/stacks"},
+		{302, `{"message":"Found"}`, "/login", "Found", "redirected to /login"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "http://portainer.example.com/api/stacks", nil)
+		rsp := &http.Response{
+			StatusCode: tt.status,
+			Status:     fmt.Sprintf("%d %s", tt.status, http.StatusText(tt.status)),
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(tt.body)),
+		}
+		if tt.location != "" {
+			rsp.Header.Set("Location", tt.location)
+		}
+
+		err := checkResponse(req, rsp)
+		if tt.status < 300 {
+			if err != nil {
+				t.Errorf("checkResponse(%d) = %v, want nil", tt.status, err)
+			}
+			continue
+		}
+
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) {
+			t.Errorf("checkResponse(%d) = %v, want an APIError", tt.status, err)
+			continue
+		}
+		if apiErr.StatusCode != tt.status || apiErr.Method != "POST" || string(apiErr.Body) != tt.body {
+			t.Errorf("checkResponse(%d) = %+v", tt.status, apiErr)
+		}
+		if apiErr.Message != tt.message || apiErr.Details != tt.details {
+			t.Errorf("checkResponse(%d, %q) message = %q, details = %q, want %q, %q", tt.status, tt.body, apiErr.Message, apiErr.Details, tt.message, tt.details)
+		}
+	}
+}
+
+// Every sentinel error matches its own status code only.
+func TestAPIErrorIs(t *testing.T) {
+	sentinels := map[error]int{
+		ErrUnauthorized: http.StatusUnauthorized,
+		ErrForbidden:    http.StatusForbidden,
+		ErrNotFound:     http.StatusNotFound,
+		ErrConflict:     http.StatusConflict,
+	}
+
+	for _, status := range []int{301, 400, 401, 403, 404, 409, 500} {
+		err := fmt.Errorf("wrapped: %w", &APIError{StatusCode: status})
+		for target, code := range sentinels {
+			if got := errors.Is(err, target); got != (status == code) {
+				t.Errorf("errors.Is(%d, %v) = %v", status, target, got)
+			}
+		}
+	}
+
+	if errors.Is(errors.New("not found"), ErrNotFound) {
+		t.Error("errors.Is() matches a plain error")
+	}
+}
+
+// Redirects are not followed, a POST would turn into a GET.
+func TestRedirectNotFollowed(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Redirect(w, r, "/login", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	prtnr, err := NewPortainer(srv.URL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = prtnr.GetStacks()
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusFound || apiErr.Details != "redirected to /login" {
+		t.Errorf("GetStacks() error = %v, want the redirect", err)
+	}
+	if requests != 1 {
+		t.Errorf("GetStacks() sent %d requests, want 1", requests)
+	}
+}
@@ -0,0 +1,111 @@
+package portainer
+
+import (
+	"context"
+	"fmt"
+)
+
+// GitConfig is the repository a git-backed stack was created from.
+type GitConfig struct {
+	URL            string `json:"URL"`
+	ReferenceName  string `json:"ReferenceName"`
+	ConfigFilePath string `json:"ConfigFilePath"`
+	ConfigHash     string `json:"ConfigHash"`
+}
+
+// GitRepository describes where to fetch a stack file from.
+type GitRepository struct {
+	URL             string
+	Reference       string
+	ComposeFile     string
+	AdditionalFiles []string
+	Username        string
+	Password        string
+}
+
+func (self *GitRepository) authentication() bool {
+	return len(self.Username) > 0 && len(self.Password) > 0
+}
+
+// DeployStackFromGit creates a stack from the stack file at path in the default branch of repo.
+func (self *Portainer) DeployStackFromGit(endpoint *Endpoint, name string, repo string, path string, user string, pass string, env ...*Env) error {
+	return self.DeployStackFromGitContext(context.Background(), endpoint, name, repo, path, user, pass, env...)
+}
+
+func (self *Portainer) DeployStackFromGitContext(ctx context.Context, endpoint *Endpoint, name string, repo string, path string, user string, pass string, env ...*Env) error {
+	return self.DeployStackFromGitRepositoryContext(ctx, endpoint, name, &GitRepository{
+		URL:         repo,
+		ComposeFile: path,
+		Username:    user,
+		Password:    pass,
+	}, env...)
+}
+
+// DeployStackFromGitRepository creates a stack from the reference and files of the repository.
+func (self *Portainer) DeployStackFromGitRepository(endpoint *Endpoint, name string, repo *GitRepository, env ...*Env) error {
+	return self.DeployStackFromGitRepositoryContext(context.Background(), endpoint, name, repo, env...)
+}
+
+func (self *Portainer) DeployStackFromGitRepositoryContext(ctx context.Context, endpoint *Endpoint, name string, repo *GitRepository, env ...*Env) error {
+	r, err := newRequest("POST", fmt.Sprintf("%s/api/stacks?type=%d&method=repository&endpointId=%d", self.address, endpoint.stackType(), endpoint.Id), &struct {
+		Name                        string   `json:"Name"`
+		SwarmID                     string   `json:"SwarmID,omitempty"`
+		RepositoryURL               string   `json:"RepositoryURL"`
+		RepositoryReferenceName     string   `json:"RepositoryReferenceName,omitempty"`
+		ComposeFile                 string   `json:"ComposeFile"`
+		ComposeFilePathInRepository string   `json:"ComposeFilePathInRepository"`
+		AdditionalFiles             []string `json:"AdditionalFiles,omitempty"`
+		RepositoryAuthentication    bool     `json:"RepositoryAuthentication"`
+		RepositoryUsername          string   `json:"RepositoryUsername"`
+		RepositoryPassword          string   `json:"RepositoryPassword"`
+		Env                         []*Env   `json:"Env"`
+	}{
+		Name:                        name,
+		SwarmID:                     endpoint.swarmID(),
+		RepositoryURL:               repo.URL,
+		RepositoryReferenceName:     repo.Reference,
+		ComposeFile:                 repo.ComposeFile,
+		ComposeFilePathInRepository: repo.ComposeFile,
+		AdditionalFiles:             repo.AdditionalFiles,
+		RepositoryAuthentication:    repo.authentication(),
+		RepositoryUsername:          repo.Username,
+		RepositoryPassword:          repo.Password,
+		Env:                         env,
+	})
+	if err != nil {
+		return err
+	}
+
+	r.applied = self.stackApplied(ctx, endpoint, name)
+
+	return self.send(ctx, r, nil)
+}
+
+// RedeployStackFromGit pulls the stack file from its repository again and updates the stack.
+func (self *Portainer) RedeployStackFromGit(stack *Stack, repo *GitRepository, prune bool, pull bool, env ...*Env) error {
+	return self.RedeployStackFromGitContext(context.Background(), stack, repo, prune, pull, env...)
+}
+
+func (self *Portainer) RedeployStackFromGitContext(ctx context.Context, stack *Stack, repo *GitRepository, prune bool, pull bool, env ...*Env) error {
+	if stack.GitConfig == nil {
+		return fmt.Errorf("Stack \"%s\" is not deployed from git", stack.Name)
+	}
+
+	return self.api(ctx, "PUT", fmt.Sprintf("stacks/%d/git/redeploy?endpointId=%d", stack.Id, stack.EndpointID), &struct {
+		RepositoryReferenceName  string `json:"RepositoryReferenceName,omitempty"`
+		RepositoryAuthentication bool   `json:"RepositoryAuthentication"`
+		RepositoryUsername       string `json:"RepositoryUsername"`
+		RepositoryPassword       string `json:"RepositoryPassword"`
+		Prune                    bool   `json:"Prune"`
+		PullImage                bool   `json:"PullImage"`
+		Env                      []*Env `json:"Env"`
+	}{
+		RepositoryReferenceName:  repo.Reference,
+		RepositoryAuthentication: repo.authentication(),
+		RepositoryUsername:       repo.Username,
+		RepositoryPassword:       repo.Password,
+		Prune:                    prune,
+		PullImage:                pull,
+		Env:                      env,
+	}, nil)
+}
@@ -0,0 +1,81 @@
+package portainer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+)
+
+func (self *Portainer) DeployKubernetesStackFromString(endpoint *Endpoint, name string, namespace string, compose bool, config string) error {
+	return self.DeployKubernetesStackFromStringContext(context.Background(), endpoint, name, namespace, compose, config)
+}
+
+func (self *Portainer) DeployKubernetesStackFromStringContext(ctx context.Context, endpoint *Endpoint, name string, namespace string, compose bool, config string) error {
+	if !endpoint.IsKubernetes() {
+		return fmt.Errorf("Endpoint \"%s\" is not a Kubernetes endpoint", endpoint.Name)
+	}
+
+	r, err := newRequest("POST", fmt.Sprintf("%s/api/stacks?type=%d&method=string&endpointId=%d", self.address, StackTypeKubernetes, endpoint.Id), &struct {
+		StackName        string `json:"StackName"`
+		Namespace        string `json:"Namespace"`
+		ComposeFormat    bool   `json:"ComposeFormat"`
+		StackFileContent string `json:"StackFileContent"`
+	}{
+		StackName:        name,
+		Namespace:        namespace,
+		ComposeFormat:    compose,
+		StackFileContent: config,
+	})
+	if err != nil {
+		return err
+	}
+
+	r.applied = self.stackApplied(ctx, endpoint, name)
+
+	return self.send(ctx, r, nil)
+}
+
+func (self *Portainer) DeployKubernetesStackFromFile(endpoint *Endpoint, name string, namespace string, compose bool, path string) error {
+	return self.DeployKubernetesStackFromFileContext(context.Background(), endpoint, name, namespace, compose, path)
+}
+
+func (self *Portainer) DeployKubernetesStackFromFileContext(ctx context.Context, endpoint *Endpoint, name string, namespace string, compose bool, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return self.DeployKubernetesStackFromStringContext(ctx, endpoint, name, namespace, compose, string(data))
+}
+
+// UpdateKubernetesStackFromString replaces the manifest of a Kubernetes stack.
+// Kubernetes stacks have no environment, unlike the stacks updated by
+// UpdateStackFromString.
+func (self *Portainer) UpdateKubernetesStackFromString(stack *Stack, config string) error {
+	return self.UpdateKubernetesStackFromStringContext(context.Background(), stack, config)
+}
+
+func (self *Portainer) UpdateKubernetesStackFromStringContext(ctx context.Context, stack *Stack, config string) error {
+	if stack.Type != StackTypeKubernetes {
+		return fmt.Errorf("Stack \"%s\" is not a Kubernetes stack", stack.Name)
+	}
+
+	return self.api(ctx, "PUT", fmt.Sprintf("stacks/%d?endpointId=%d", stack.Id, stack.EndpointID), &struct {
+		StackFileContent string `json:"StackFileContent"`
+	}{
+		StackFileContent: config,
+	}, nil)
+}
+
+func (self *Portainer) UpdateKubernetesStackFromFile(stack *Stack, path string) error {
+	return self.UpdateKubernetesStackFromFileContext(context.Background(), stack, path)
+}
+
+func (self *Portainer) UpdateKubernetesStackFromFileContext(ctx context.Context, stack *Stack, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return self.UpdateKubernetesStackFromStringContext(ctx, stack, string(data))
+}
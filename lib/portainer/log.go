@@ -0,0 +1,133 @@
+package portainer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxLogBody is the size above which logged request and response bodies are truncated.
+const maxLogBody = 4096
+
+const redacted = "********"
+
+// sensitiveHeaders are never logged as they are.
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "X-Api-Key", "Cookie", "Set-Cookie"}
+
+// sensitiveFields are the JSON fields masked in logged bodies: credentials, tokens
+// and the data of swarm secrets. Matched case-insensitively.
+var sensitiveFields = map[string]bool{
+	"password":           true,
+	"repositorypassword": true,
+	"jwt":                true,
+	"token":              true,
+	"apikey":             true,
+	"data":               true,
+}
+
+// SetLogger logs every request and its response at debug level, with credentials
+// redacted. A nil logger disables logging.
+func (self *Portainer) SetLogger(log *slog.Logger) {
+	self.log = log
+}
+
+// SetSecretEnv masks the values of the stack environment variables with these
+// names in logged bodies.
+func (self *Portainer) SetSecretEnv(names []string) {
+	self.secretEnv = map[string]bool{}
+	for _, name := range names {
+		self.secretEnv[name] = true
+	}
+}
+
+// trace logs a single attempt of a request.
+func (self *Portainer) trace(ctx context.Context, req *http.Request, body []byte, rsp *http.Response, data []byte, err error, duration time.Duration) {
+	if self.log == nil || !self.log.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+
+	args := []any{
+		"method", req.Method,
+		"url", req.URL.Redacted(),
+		"headers", redactHeaders(req.Header),
+		"duration", duration.Round(time.Millisecond),
+	}
+	if body != nil {
+		args = append(args, "request", self.redactBody(body))
+	}
+	if rsp != nil {
+		args = append(args, "status", rsp.StatusCode)
+	}
+	if data != nil {
+		args = append(args, "response", self.redactBody(data))
+	}
+	if err != nil {
+		args = append(args, "error", err)
+	}
+
+	self.log.DebugContext(ctx, "Portainer API request", args...)
+}
+
+func redactHeaders(header http.Header) string {
+	var fields []string
+	for name, values := range header {
+		value := strings.Join(values, ", ")
+		for _, sensitive := range sensitiveHeaders {
+			if strings.EqualFold(name, sensitive) {
+				value = redacted
+			}
+		}
+		fields = append(fields, fmt.Sprintf("%s: %s", name, value))
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, "; ")
+}
+
+// redactBody masks the sensitive fields and secret environment values of a JSON
+// body and truncates it.
+func (self *Portainer) redactBody(data []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err == nil {
+		var masked bytes.Buffer
+		enc := json.NewEncoder(&masked)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(self.redactValue(v)); err == nil {
+			data = bytes.TrimRight(masked.Bytes(), "\n")
+		}
+	}
+
+	if len(data) > maxLogBody {
+		return fmt.Sprintf("%s... (%d bytes)", data[:maxLogBody], len(data))
+	}
+	return string(data)
+}
+
+func (self *Portainer) redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if sensitiveFields[strings.ToLower(key)] {
+				v[key] = redacted
+			} else {
+				v[key] = self.redactValue(value)
+			}
+		}
+		// stack environment entries
+		if name, ok := v["name"].(string); ok && self.secretEnv[name] {
+			if _, ok := v["value"]; ok {
+				v["value"] = redacted
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = self.redactValue(value)
+		}
+	}
+	return v
+}
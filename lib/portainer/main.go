@@ -1 +1,5 @@
+// Package portainer is a client of the Portainer API.
+//
+// Every method has a variant with a Context suffix taking a context.Context
+// which cancels requests, retries and polling.
 package portainer
@@ -1,30 +1,61 @@
 package portainer
 
 import (
-	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/goware/urlx"
 )
 
+const (
+	StackTypeSwarm      = 1
+	StackTypeCompose    = 2
+	StackTypeKubernetes = 3
+)
+
+const (
+	StackStatusActive   = 1
+	StackStatusInactive = 2
+)
+
+const (
+	EndpointTypeDocker          = 1
+	EndpointTypeAgent           = 2
+	EndpointTypeAzure           = 3
+	EndpointTypeEdgeAgent       = 4
+	EndpointTypeKubernetes      = 5
+	EndpointTypeKubernetesAgent = 6
+	EndpointTypeKubernetesEdge  = 7
+)
+
 type Env struct {
 	Name  string `json:"name"`
 	Value string `json:"value"`
 }
 
 type Stack struct {
-	Id          int    `json:"Id"`
-	Name        string `json:"Name"`
-	Type        int    `json:"Type"`
-	EndpointID  int    `json:"EndpointID"`
-	EntryPoint  string `json:"EntryPoint"`
-	SwarmID     string `json:"SwarmID"`
-	ProjectPath string `json:"ProjectPath"`
-	Env         []*Env `json:"Env"`
+	Id          int        `json:"Id"`
+	Name        string     `json:"Name"`
+	Type        int        `json:"Type"`
+	EndpointID  int        `json:"EndpointID"`
+	Status      int        `json:"Status"`
+	EntryPoint  string     `json:"EntryPoint"`
+	SwarmID     string     `json:"SwarmID"`
+	ProjectPath string     `json:"ProjectPath"`
+	Namespace   string     `json:"Namespace,omitempty"`
+	GitConfig   *GitConfig `json:"GitConfig,omitempty"`
+	Env         []*Env     `json:"Env"`
+
+	CreationDate int64 `json:"CreationDate"`
+	UpdateDate   int64 `json:"UpdateDate"`
 }
 
 type Endpoint struct {
@@ -34,187 +65,197 @@ type Endpoint struct {
 	URL       string `json:"URL"`
 	GroupId   int    `json:"GroupId"`
 	PublicURL string `json:"PublicURL"`
+	TagIds    []int  `json:"TagIds"`
 	SwarmID   string `json:"SwarmID,omitempty"`
-}
 
-type Portainer struct {
-	client  *http.Client
-	address string
-	auth    string
+	// StackType is the type of stacks created on the endpoint,
+	// detected from its swarm state unless set explicitly.
+	StackType int `json:"-"`
 }
 
-func NewPortainer(address string, insecure bool) (*Portainer, error) {
-	tlsconfig := &tls.Config{InsecureSkipVerify: insecure}
-	transport := &http.Transport{TLSClientConfig: tlsconfig}
-	client := &http.Client{Transport: transport}
-
-	url, err := urlx.Parse(address)
-	if err != nil {
-		return nil, fmt.Errorf("Address parsing error : %s", err)
+func (self *Endpoint) IsKubernetes() bool {
+	switch self.Type {
+	case EndpointTypeKubernetes, EndpointTypeKubernetesAgent, EndpointTypeKubernetesEdge:
+		return true
 	}
+	return false
+}
 
-	if url.Scheme == "" {
-		switch url.Port() {
-		case "443":
-			url.Scheme = "https://"
-			break
-		default:
-			url.Scheme = "https://"
-		}
+func (self *Endpoint) stackType() int {
+	if self.StackType != 0 {
+		return self.StackType
 	}
+	if self.IsKubernetes() {
+		return StackTypeKubernetes
+	}
+	if self.SwarmID != "" {
+		return StackTypeSwarm
+	}
+	return StackTypeCompose
+}
 
-	address, err = urlx.Normalize(url)
-	if err != nil {
-		return nil, fmt.Errorf("Address normalizing error : %s", err)
+// swarmID is the swarm cluster ID sent with new stacks, empty for non-swarm stacks.
+func (self *Endpoint) swarmID() string {
+	if self.stackType() != StackTypeSwarm {
+		return ""
 	}
+	return self.SwarmID
+}
 
-	return &Portainer{
-		client:  client,
-		address: address,
-	}, nil
+type Portainer struct {
+	client    *http.Client
+	transport *http.Transport
+	address   string
+	auth      Authenticator
+	retry     RetryPolicy
+	timeout   time.Duration
+	log       *slog.Logger
+	secretEnv map[string]bool
+
+	// dialer settings, see dialContext
+	socket         string
+	localAddr      net.Addr
+	connectTimeout time.Duration
 }
 
-func (self *Portainer) Connect() error {
-	req, err := http.NewRequest("HEAD", fmt.Sprintf("%s/", self.address), nil)
-	if err != nil {
-		return err
+const (
+	DefaultConnectTimeout = 30 * time.Second
+	DefaultRequestTimeout = 10 * time.Minute
+)
+
+func NewPortainer(address string, insecure bool) (*Portainer, error) {
+	return NewPortainerTLS(address, &TLSOptions{Insecure: insecure})
+}
+
+// NewPortainerTLS creates a client which verifies the server and authenticates
+// itself as set in the TLS options.
+func NewPortainerTLS(address string, options *TLSOptions) (*Portainer, error) {
+	if options == nil {
+		options = &TLSOptions{}
 	}
 
-	rsp, err := self.client.Do(req)
+	tlsconfig, err := options.config()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer rsp.Body.Close()
 
-	if rsp.StatusCode >= 400 {
-		return fmt.Errorf("Portainer API error: %s %s %s", req.Method, req.URL.String(), rsp.Status)
-	}
+	p := &Portainer{retry: DefaultRetryPolicy}
 
-	return nil
-}
+	p.transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		DialContext:     p.dialContext,
+		TLSClientConfig: tlsconfig,
+	}
+	p.client = &http.Client{
+		Transport: p.transport,
+		// redirects are reported as errors instead of silently turning POST and PUT into GET
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
 
-func (self *Portainer) Auth(user, pass string) error {
-	args, err := json.Marshal(&struct {
-		Username string `json:"Username"`
-		Password string `json:"Password"`
-	}{
-		Username: user,
-		Password: pass,
-	})
-	if err != nil {
-		return err
+	// unix:///path/to/portainer.sock talks HTTP over the socket
+	if strings.HasPrefix(address, "unix://") {
+		p.socket = strings.TrimPrefix(address, "unix://")
+		if p.socket == "" {
+			return nil, fmt.Errorf("Address parsing error : socket path not defined")
+		}
+		p.transport.Proxy = nil
+		address = "http://portainer"
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/auth", self.address), bytes.NewBuffer(args))
+	url, err := urlx.ParseWithDefaultScheme(address, defaultScheme(address))
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("Address parsing error : %s", err)
 	}
 
-	rsp, err := self.client.Do(req)
+	p.address, err = urlx.Normalize(url)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("Address normalizing error : %s", err)
 	}
-	defer rsp.Body.Close()
 
-	if rsp.StatusCode > 200 {
-		data, err := ioutil.ReadAll(rsp.Body)
-		if err != nil {
-			return err
-		}
+	p.SetTimeouts(DefaultConnectTimeout, DefaultRequestTimeout)
 
-		var auth struct {
-			ERR string `json:"err"`
-		}
+	return p, nil
+}
 
-		err = json.Unmarshal(data, &auth)
-		if err != nil {
-			return err
-		}
+// SetTimeouts limits establishing a connection, including the TLS handshake, and
+// each request attempt. Zero disables a limit.
+func (self *Portainer) SetTimeouts(connect, request time.Duration) {
+	self.connectTimeout = connect
+	self.transport.TLSHandshakeTimeout = connect
+	self.timeout = request
+}
 
-		return fmt.Errorf("Portainer API error: %s %s %s - %s", req.Method, req.URL.String(), rsp.Status, auth.ERR)
-	}
+func (self *Portainer) Connect() error {
+	return self.ConnectContext(context.Background())
+}
 
-	data, err := ioutil.ReadAll(rsp.Body)
+func (self *Portainer) ConnectContext(ctx context.Context) error {
+	r, err := newRequest("HEAD", fmt.Sprintf("%s/", self.address), nil)
 	if err != nil {
 		return err
 	}
 
-	var auth struct {
-		JWT string `json:"jwt"`
-	}
+	return self.send(ctx, r, nil)
+}
 
-	err = json.Unmarshal(data, &auth)
-	if err != nil {
-		return err
-	}
+// Auth logs in with a username and password.
+func (self *Portainer) Auth(user, pass string) error {
+	return self.AuthContext(context.Background(), user, pass)
+}
 
-	self.auth = auth.JWT
+func (self *Portainer) AuthContext(ctx context.Context, user, pass string) error {
+	return self.AuthenticateContext(ctx, &PasswordAuth{Username: user, Password: pass})
+}
 
-	return nil
+// Authenticate sets the credential strategy used for all subsequent requests.
+func (self *Portainer) Authenticate(auth Authenticator) error {
+	return self.AuthenticateContext(context.Background(), auth)
 }
 
-func (self *Portainer) GetEndpointByName(endpoint string) (*Endpoint, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/api/endpoints", self.address), nil)
-	if err != nil {
-		return nil, err
+func (self *Portainer) AuthenticateContext(ctx context.Context, auth Authenticator) error {
+	if auth == nil {
+		return fmt.Errorf("Portainer credentials not defined")
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", self.auth))
 
-	rsp, err := self.client.Do(req)
-	if err != nil {
-		return nil, err
+	login := auth.Login
+	if a, ok := auth.(ContextAuthenticator); ok {
+		login = func(p *Portainer) error { return a.LoginContext(ctx, p) }
 	}
-	defer rsp.Body.Close()
 
-	if rsp.StatusCode > 200 {
-		return nil, fmt.Errorf("Portainer API error: %s %s %s", req.Method, req.URL.String(), rsp.Status)
+	if err := login(self); err != nil {
+		return err
 	}
 
-	data, err := ioutil.ReadAll(rsp.Body)
-	if err != nil {
-		return nil, err
+	self.auth = auth
+
+	return nil
+}
+
+func (self *Portainer) authorize(req *http.Request) {
+	if self.auth != nil {
+		self.auth.Authorize(req)
 	}
+}
 
-	var endpoints []*Endpoint
+func (self *Portainer) GetEndpointByName(endpoint string) (*Endpoint, error) {
+	return self.GetEndpointByNameContext(context.Background(), endpoint)
+}
 
-	err = json.Unmarshal(data, &endpoints)
+func (self *Portainer) GetEndpointByNameContext(ctx context.Context, endpoint string) (*Endpoint, error) {
+	endpoints, err := self.GetEndpointsContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, e := range endpoints {
 		if e.Name == endpoint {
-			req, err := http.NewRequest("GET", fmt.Sprintf("%s/api/endpoints/%d/docker/swarm", self.address, e.Id), nil)
-			if err != nil {
-				return nil, err
-			}
-			req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", self.auth))
-
-			rsp, err := self.client.Do(req)
-			if err != nil {
-				return nil, err
-			}
-			defer rsp.Body.Close()
-
-			if rsp.StatusCode > 200 {
-				return nil, fmt.Errorf("Portainer API error: %s %s %s", req.Method, req.URL.String(), rsp.Status)
-			}
-
-			data, err := ioutil.ReadAll(rsp.Body)
-			if err != nil {
-				return nil, err
-			}
-
-			var swarm struct {
-				ID string
-			}
-
-			err = json.Unmarshal(data, &swarm)
+			err = self.detectStackType(ctx, e)
 			if err != nil {
 				return nil, err
 			}
 
-			e.SwarmID = swarm.ID
 			return e, nil
 		}
 	}
@@ -222,137 +263,159 @@ func (self *Portainer) GetEndpointByName(endpoint string) (*Endpoint, error) {
 	return nil, fmt.Errorf("Endpoint \"%s\" not found", endpoint)
 }
 
-func (self *Portainer) GetStackByName(name string) (*Stack, error) {
-	if name == "" {
-		return nil, fmt.Errorf("Stack name not defined")
-	}
+// StackFilters restricts the stacks listed by Portainer.
+type StackFilters struct {
+	EndpointID int    `json:"EndpointID,omitempty"`
+	SwarmID    string `json:"SwarmID,omitempty"`
+}
 
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/api/stacks", self.address), nil)
-	if err != nil {
-		return nil, err
+func (self *Portainer) GetStacks() ([]*Stack, error) {
+	return self.GetStacksContext(context.Background())
+}
+
+func (self *Portainer) GetStacksContext(ctx context.Context) ([]*Stack, error) {
+	return self.FindStacksContext(ctx, nil)
+}
+
+// FindStacks lists the stacks matching the filters, or all stacks if filters is nil.
+func (self *Portainer) FindStacks(filters *StackFilters) ([]*Stack, error) {
+	return self.FindStacksContext(context.Background(), filters)
+}
+
+func (self *Portainer) FindStacksContext(ctx context.Context, filters *StackFilters) ([]*Stack, error) {
+	path := "stacks"
+	if filters != nil {
+		args, err := json.Marshal(filters)
+		if err != nil {
+			return nil, err
+		}
+		path += "?filters=" + url.QueryEscape(string(args))
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", self.auth))
 
-	rsp, err := self.client.Do(req)
-	if err != nil {
+	var stacks []*Stack
+	if err := self.api(ctx, "GET", path, nil, &stacks); err != nil {
 		return nil, err
 	}
-	defer rsp.Body.Close()
 
-	if rsp.StatusCode > 200 {
-		return nil, fmt.Errorf("Portainer API error: %s %s %s", req.Method, req.URL.String(), rsp.Status)
+	// older Portainer versions ignore the filters
+	if filters == nil {
+		return stacks, nil
 	}
 
-	data, err := ioutil.ReadAll(rsp.Body)
-	if err != nil {
-		return nil, err
+	var found []*Stack
+	for _, stack := range stacks {
+		if filters.EndpointID != 0 && stack.EndpointID != filters.EndpointID {
+			continue
+		}
+		if filters.SwarmID != "" && stack.SwarmID != filters.SwarmID {
+			continue
+		}
+		found = append(found, stack)
 	}
 
-	var stacks []*Stack
+	return found, nil
+}
+
+// GetStack returns the stack with the name on the endpoint, or nil if there is none.
+// Swarm stacks only match if they belong to the endpoint's swarm cluster, compose
+// stacks of a swarm endpoint always do.
+func (self *Portainer) GetStack(endpoint *Endpoint, name string) (*Stack, error) {
+	return self.GetStackContext(context.Background(), endpoint, name)
+}
+
+func (self *Portainer) GetStackContext(ctx context.Context, endpoint *Endpoint, name string) (*Stack, error) {
+	if name == "" {
+		return nil, fmt.Errorf("Stack name not defined")
+	}
 
-	err = json.Unmarshal(data, &stacks)
+	stacks, err := self.FindStacksContext(ctx, &StackFilters{EndpointID: endpoint.Id})
 	if err != nil {
 		return nil, err
 	}
 
+	var found *Stack
 	for _, stack := range stacks {
-		if stack.Name == name {
-			return stack, nil
+		if stack.Name != name {
+			continue
+		}
+		if stack.Type == StackTypeSwarm && endpoint.SwarmID != "" && stack.SwarmID != endpoint.SwarmID {
+			continue
 		}
+		if found != nil {
+			return nil, fmt.Errorf("Stack \"%s\" is ambiguous on endpoint \"%s\": stacks %d and %d", name, endpoint.Name, found.Id, stack.Id)
+		}
+		found = stack
 	}
 
-	return nil, nil
+	return found, nil
 }
 
-func (self *Portainer) DeployStackFromGit(endpoint *Endpoint, name string, repo string, path string, user string, pass string, env ...*Env) error {
-	args, err := json.Marshal(&struct {
-		Name                        string `json:"Name"`
-		SwarmID                     string `json:"SwarmID"`
-		RepositoryURL               string `json:"RepositoryURL"`
-		ComposeFilePathInRepository string `json:"ComposeFilePathInRepository"`
-		RepositoryAuthentication    bool   `json:"RepositoryAuthentication"`
-		RepositoryUsername          string `json:"RepositoryUsername"`
-		RepositoryPassword          string `json:"RepositoryPassword"`
-		Env                         []*Env `json:"Env"`
-	}{
-		Name:                        name,
-		SwarmID:                     endpoint.SwarmID,
-		RepositoryURL:               repo,
-		ComposeFilePathInRepository: path,
-		RepositoryAuthentication:    (len(user) > 0 && len(pass) > 0),
-		RepositoryUsername:          user,
-		RepositoryPassword:          pass,
-		Env:                         env,
-	})
-	if err != nil {
-		return err
-	}
+func (self *Portainer) GetStackByName(name string) (*Stack, error) {
+	return self.GetStackByNameContext(context.Background(), name)
+}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/stacks?type=1&method=repository&endpointId=%d", self.address, endpoint.Id), bytes.NewBuffer(args))
-	if err != nil {
-		return err
+func (self *Portainer) GetStackByNameContext(ctx context.Context, name string) (*Stack, error) {
+	if name == "" {
+		return nil, fmt.Errorf("Stack name not defined")
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", self.auth))
 
-	rsp, err := self.client.Do(req)
+	stacks, err := self.GetStacksContext(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer rsp.Body.Close()
 
-	if rsp.StatusCode > 200 {
-		return fmt.Errorf("Portainer API error: %s %s %s", req.Method, req.URL.String(), rsp.Status)
+	for _, stack := range stacks {
+		if stack.Name == name {
+			return stack, nil
+		}
 	}
 
-	return nil
+	return nil, nil
 }
 
 func (self *Portainer) DeployStackFromString(endpoint *Endpoint, name string, config string, env ...*Env) error {
-	args, err := json.Marshal(&struct {
+	return self.DeployStackFromStringContext(context.Background(), endpoint, name, config, env...)
+}
+
+func (self *Portainer) DeployStackFromStringContext(ctx context.Context, endpoint *Endpoint, name string, config string, env ...*Env) error {
+	r, err := newRequest("POST", fmt.Sprintf("%s/api/stacks?type=%d&method=string&endpointId=%d", self.address, endpoint.stackType(), endpoint.Id), &struct {
 		Name             string `json:"Name"`
-		SwarmID          string `json:"SwarmID"`
+		SwarmID          string `json:"SwarmID,omitempty"`
 		StackFileContent string `json:"StackFileContent"`
 		Env              []*Env `json:"Env"`
 	}{
 		Name:             name,
-		SwarmID:          endpoint.SwarmID,
+		SwarmID:          endpoint.swarmID(),
 		StackFileContent: config,
 		Env:              env,
 	})
 	if err != nil {
 		return err
 	}
+	r.applied = self.stackApplied(ctx, endpoint, name)
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/stacks?type=1&method=string&endpointId=%d", self.address, endpoint.Id), bytes.NewBuffer(args))
-	if err != nil {
-		return err
-	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", self.auth))
-
-	rsp, err := self.client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer rsp.Body.Close()
-
-	if rsp.StatusCode > 200 {
-		return fmt.Errorf("Portainer API error: %s %s %s", req.Method, req.URL.String(), rsp.Status)
-	}
-
-	return nil
+	return self.send(ctx, r, nil)
 }
 
 func (self *Portainer) DeployStackFromFile(endpoint *Endpoint, name string, path string, env ...*Env) error {
+	return self.DeployStackFromFileContext(context.Background(), endpoint, name, path, env...)
+}
+
+func (self *Portainer) DeployStackFromFileContext(ctx context.Context, endpoint *Endpoint, name string, path string, env ...*Env) error {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return err
 	}
 
-	return self.DeployStackFromString(endpoint, name, string(data), env...)
+	return self.DeployStackFromStringContext(ctx, endpoint, name, string(data), env...)
 }
 
 func (self *Portainer) UpdateStackFromString(stack *Stack, config string, prune bool, env ...*Env) error {
-	args, err := json.Marshal(&struct {
+	return self.UpdateStackFromStringContext(context.Background(), stack, config, prune, env...)
+}
+
+func (self *Portainer) UpdateStackFromStringContext(ctx context.Context, stack *Stack, config string, prune bool, env ...*Env) error {
+	return self.api(ctx, "PUT", fmt.Sprintf("stacks/%d?endpointId=%d", stack.Id, stack.EndpointID), &struct {
 		StackFileContent string `json:"StackFileContent"`
 		Prune            bool   `json:"Prune"`
 		Env              []*Env `json:"Env"`
@@ -360,35 +423,107 @@ func (self *Portainer) UpdateStackFromString(stack *Stack, config string, prune
 		StackFileContent: config,
 		Prune:            prune,
 		Env:              env,
-	})
+	}, nil)
+}
+
+func (self *Portainer) UpdateStackFromFile(stack *Stack, path string, prune bool, env ...*Env) error {
+	return self.UpdateStackFromFileContext(context.Background(), stack, path, prune, env...)
+}
+
+func (self *Portainer) UpdateStackFromFileContext(ctx context.Context, stack *Stack, path string, prune bool, env ...*Env) error {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return err
 	}
 
-	req, err := http.NewRequest("PUT", fmt.Sprintf("%s/api/stacks/%d?endpointId=%d", self.address, stack.Id, stack.EndpointID), bytes.NewBuffer(args))
-	if err != nil {
-		return err
+	return self.UpdateStackFromStringContext(ctx, stack, string(data), prune, env...)
+}
+
+func (self *Portainer) GetStackFile(stack *Stack) (string, error) {
+	return self.GetStackFileContext(context.Background(), stack)
+}
+
+func (self *Portainer) GetStackFileContext(ctx context.Context, stack *Stack) (string, error) {
+	var file struct {
+		StackFileContent string `json:"StackFileContent"`
+	}
+
+	if err := self.api(ctx, "GET", fmt.Sprintf("stacks/%d/file", stack.Id), nil, &file); err != nil {
+		return "", err
+	}
+
+	return file.StackFileContent, nil
+}
+
+func (self *Portainer) DeleteStack(stack *Stack) error {
+	return self.DeleteStackContext(context.Background(), stack)
+}
+
+func (self *Portainer) DeleteStackContext(ctx context.Context, stack *Stack) error {
+	return self.api(ctx, "DELETE", fmt.Sprintf("stacks/%d?endpointId=%d", stack.Id, stack.EndpointID), nil, nil)
+}
+
+// MigrateStack moves the stack to another endpoint, renaming it unless name is empty.
+func (self *Portainer) MigrateStack(stack *Stack, endpoint *Endpoint, name string) error {
+	return self.MigrateStackContext(context.Background(), stack, endpoint, name)
+}
+
+func (self *Portainer) MigrateStackContext(ctx context.Context, stack *Stack, endpoint *Endpoint, name string) error {
+	target := name
+	if target == "" {
+		target = stack.Name
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", self.auth))
 
-	rsp, err := self.client.Do(req)
+	r, err := newRequest("POST", fmt.Sprintf("%s/api/stacks/%d/migrate?endpointId=%d", self.address, stack.Id, stack.EndpointID), &struct {
+		EndpointID int    `json:"EndpointID"`
+		SwarmID    string `json:"SwarmID,omitempty"`
+		Name       string `json:"Name,omitempty"`
+	}{
+		EndpointID: endpoint.Id,
+		SwarmID:    endpoint.swarmID(),
+		Name:       name,
+	})
 	if err != nil {
 		return err
 	}
-	defer rsp.Body.Close()
+	r.applied = self.stackApplied(ctx, endpoint, target)
 
-	if rsp.StatusCode > 200 {
-		return fmt.Errorf("Portainer API error: %s %s %s", req.Method, req.URL.String(), rsp.Status)
-	}
+	return self.send(ctx, r, nil)
+}
 
-	return nil
+func (self *Portainer) StartStack(stack *Stack) error {
+	return self.StartStackContext(context.Background(), stack)
 }
 
-func (self *Portainer) UpdateStackFromFile(stack *Stack, path string, prune bool, env ...*Env) error {
-	data, err := ioutil.ReadFile(path)
+func (self *Portainer) StartStackContext(ctx context.Context, stack *Stack) error {
+	return self.stackAction(ctx, stack, "start")
+}
+
+func (self *Portainer) StopStack(stack *Stack) error {
+	return self.StopStackContext(context.Background(), stack)
+}
+
+func (self *Portainer) StopStackContext(ctx context.Context, stack *Stack) error {
+	return self.stackAction(ctx, stack, "stop")
+}
+
+func (self *Portainer) stackAction(ctx context.Context, stack *Stack, action string) error {
+	status := StackStatusActive
+	if action == "stop" {
+		status = StackStatusInactive
+	}
+
+	r, err := newRequest("POST", fmt.Sprintf("%s/api/stacks/%d/%s?endpointId=%d", self.address, stack.Id, action, stack.EndpointID), nil)
 	if err != nil {
 		return err
 	}
+	r.applied = func() (bool, error) {
+		var current Stack
+		if err := self.api(ctx, "GET", fmt.Sprintf("stacks/%d", stack.Id), nil, &current); err != nil {
+			return false, err
+		}
+		return current.Status == status, nil
+	}
 
-	return self.UpdateStackFromString(stack, string(data), prune, env...)
+	return self.send(ctx, r, nil)
 }
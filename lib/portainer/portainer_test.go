@@ -0,0 +1,42 @@
+package portainer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Compose stacks of a swarm endpoint are found, swarm stacks of another cluster are not.
+func TestGetStackOnSwarmEndpoint(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+			{"Id":1,"Name":"web","Type":2,"EndpointID":1},
+			{"Id":2,"Name":"api","Type":1,"EndpointID":1,"SwarmID":"old"},
+			{"Id":3,"Name":"api","Type":1,"EndpointID":1,"SwarmID":"current"},
+			{"Id":4,"Name":"db","Type":1,"EndpointID":1,"SwarmID":"old"},
+			{"Id":5,"Name":"web","Type":2,"EndpointID":2}
+		]`))
+	}))
+	defer srv.Close()
+
+	prtnr, err := NewPortainer(srv.URL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := &Endpoint{Id: 1, Name: "swarm", SwarmID: "current", StackType: StackTypeSwarm}
+
+	for name, want := range map[string]int{"web": 1, "api": 3, "db": 0, "missing": 0} {
+		stack, err := prtnr.GetStack(endpoint, name)
+		if err != nil {
+			t.Fatalf("GetStack(%q) error = %v", name, err)
+		}
+
+		got := 0
+		if stack != nil {
+			got = stack.Id
+		}
+		if got != want {
+			t.Errorf("GetStack(%q) = stack %d, want %d", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package portainer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy controls how transient failures are retried.
+type RetryPolicy struct {
+	// Attempts is the total number of attempts, 1 disables retries.
+	Attempts int
+	MinDelay time.Duration
+	MaxDelay time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts: 4,
+	MinDelay: 500 * time.Millisecond,
+	MaxDelay: 10 * time.Second,
+}
+
+// SetRetryPolicy replaces the retry policy of all subsequent requests.
+func (self *Portainer) SetRetryPolicy(policy RetryPolicy) {
+	self.retry = policy
+}
+
+// request is a single API call, kept so that it can be sent again.
+type request struct {
+	method string
+	url    string
+	body   []byte
+
+	// idempotent requests are retried on any transient failure.
+	idempotent bool
+	// applied reports whether an earlier attempt of a request which is not
+	// idempotent took effect. Without it such requests are only retried
+	// when the server rejected them.
+	applied func() (bool, error)
+}
+
+func newRequest(method string, url string, body interface{}) (*request, error) {
+	r := &request{
+		method:     method,
+		url:        url,
+		idempotent: method != "POST" && method != "PATCH",
+	}
+
+	if body != nil {
+		args, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r.body = args
+	}
+
+	return r, nil
+}
+
+// api sends a JSON request to the Portainer API and decodes the response into v.
+func (self *Portainer) api(ctx context.Context, method string, path string, body interface{}, v interface{}) error {
+	r, err := newRequest(method, fmt.Sprintf("%s/api/%s", self.address, path), body)
+	if err != nil {
+		return err
+	}
+
+	return self.send(ctx, r, v)
+}
+
+// send executes the request, retrying transient failures with exponential backoff,
+// and decodes the response into v.
+func (self *Portainer) send(ctx context.Context, r *request, v interface{}) error {
+	attempts := self.retry.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		data, retryAfter, err := self.sendOnce(ctx, r)
+		if err == nil {
+			if v == nil || len(bytes.TrimSpace(data)) == 0 {
+				return nil
+			}
+			if err := json.Unmarshal(data, v); err != nil {
+				return fmt.Errorf("Portainer API response parsing error : %s %s: %s", r.method, r.url, err)
+			}
+			return nil
+		}
+
+		if attempt >= attempts || ctx.Err() != nil || !transient(err) {
+			return err
+		}
+
+		if !r.idempotent && !rejected(err) {
+			if r.applied == nil {
+				return err
+			}
+
+			ok, cerr := r.applied()
+			if cerr != nil {
+				return err
+			}
+			if ok {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(self.backoff(attempt, retryAfter)):
+		}
+	}
+}
+
+func (self *Portainer) sendOnce(ctx context.Context, r *request) (data []byte, wait time.Duration, err error) {
+	if self.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, self.timeout)
+		defer cancel()
+	}
+
+	var body io.Reader
+	if r.body != nil {
+		body = bytes.NewReader(r.body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, r.method, r.url, body)
+	if err != nil {
+		return nil, 0, err
+	}
+	self.authorize(req)
+	if r.body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	start := time.Now()
+	var rsp *http.Response
+	defer func() {
+		self.trace(ctx, req, r.body, rsp, data, err, time.Since(start))
+	}()
+
+	rsp, err = self.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rsp.Body.Close()
+
+	if err := checkResponse(req, rsp); err != nil {
+		return nil, retryAfter(rsp.Header.Get("Retry-After")), err
+	}
+
+	data, err = ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return data, 0, nil
+}
+
+// transient reports whether a failure may go away when the request is sent again.
+func transient(err error) bool {
+	if e, ok := err.(*APIError); ok {
+		switch e.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	// connection failures, resets and timeouts; certificate, address and proxy
+	// configuration errors fail the same way every time
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNABORTED) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// rejected reports whether the server refused the request without processing it.
+func rejected(err error) bool {
+	e, ok := err.(*APIError)
+	return ok && e.StatusCode == http.StatusTooManyRequests
+}
+
+// backoff is the delay before the next attempt: the Retry-After of the server if it
+// sent one, otherwise an exponentially growing delay with jitter. Both are capped
+// at MaxDelay.
+func (self *Portainer) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		if self.retry.MaxDelay > 0 && retryAfter > self.retry.MaxDelay {
+			return self.retry.MaxDelay
+		}
+		return retryAfter
+	}
+
+	delay := self.retry.MinDelay << uint(attempt-1)
+	if delay <= 0 || (self.retry.MaxDelay > 0 && delay > self.retry.MaxDelay) {
+		delay = self.retry.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP date.
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if d := time.Until(date); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// stackApplied reports whether a stack creation took effect.
+func (self *Portainer) stackApplied(ctx context.Context, endpoint *Endpoint, name string) func() (bool, error) {
+	return func() (bool, error) {
+		stack, err := self.GetStackContext(ctx, endpoint, name)
+		return stack != nil, err
+	}
+}
@@ -0,0 +1,29 @@
+package portainer
+
+import (
+	"testing"
+	"time"
+)
+
+// A long Retry-After of the server does not stall the step.
+func TestBackoff(t *testing.T) {
+	p := &Portainer{retry: RetryPolicy{Attempts: 4, MinDelay: time.Second, MaxDelay: 10 * time.Second}}
+
+	tests := []struct {
+		attempt    int
+		retryAfter time.Duration
+		min, max   time.Duration
+	}{
+		{1, 0, 500 * time.Millisecond, time.Second},
+		{3, 0, 2 * time.Second, 4 * time.Second},
+		{10, 0, 5 * time.Second, 10 * time.Second},
+		{1, 3 * time.Second, 3 * time.Second, 3 * time.Second},
+		{1, time.Hour, 10 * time.Second, 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := p.backoff(tt.attempt, tt.retryAfter); got < tt.min || got > tt.max {
+			t.Errorf("backoff(%d, %s) = %s, want between %s and %s", tt.attempt, tt.retryAfter, got, tt.min, tt.max)
+		}
+	}
+}
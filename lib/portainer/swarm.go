@@ -0,0 +1,140 @@
+package portainer
+
+import (
+	"context"
+	"fmt"
+)
+
+// Kinds of swarm objects managed through the Docker API.
+const (
+	SwarmConfigs = "configs"
+	SwarmSecrets = "secrets"
+)
+
+// SwarmObject is a swarm config or secret.
+type SwarmObject struct {
+	ID        string `json:"ID"`
+	CreatedAt string `json:"CreatedAt"`
+	Spec      struct {
+		Name   string            `json:"Name"`
+		Labels map[string]string `json:"Labels"`
+	} `json:"Spec"`
+}
+
+func swarmKind(kind string) error {
+	switch kind {
+	case SwarmConfigs, SwarmSecrets:
+		return nil
+	}
+	return fmt.Errorf("Unknown swarm object kind \"%s\"", kind)
+}
+
+// GetSwarmObjects lists configs or secrets, optionally filtered by label ("key" or "key=value").
+func (self *Portainer) GetSwarmObjects(endpoint *Endpoint, kind string, label string) ([]*SwarmObject, error) {
+	return self.GetSwarmObjectsContext(context.Background(), endpoint, kind, label)
+}
+
+func (self *Portainer) GetSwarmObjectsContext(ctx context.Context, endpoint *Endpoint, kind string, label string) ([]*SwarmObject, error) {
+	if err := swarmKind(kind); err != nil {
+		return nil, err
+	}
+
+	var filters map[string][]string
+	if label != "" {
+		filters = map[string][]string{"label": {label}}
+	}
+
+	var objects []*SwarmObject
+	err := self.docker(ctx, endpoint, kind, filters, &objects)
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+func (self *Portainer) GetSwarmObjectByName(endpoint *Endpoint, kind string, name string) (*SwarmObject, error) {
+	return self.GetSwarmObjectByNameContext(context.Background(), endpoint, kind, name)
+}
+
+func (self *Portainer) GetSwarmObjectByNameContext(ctx context.Context, endpoint *Endpoint, kind string, name string) (*SwarmObject, error) {
+	if err := swarmKind(kind); err != nil {
+		return nil, err
+	}
+
+	var objects []*SwarmObject
+	err := self.docker(ctx, endpoint, kind, map[string][]string{"name": {name}}, &objects)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, object := range objects {
+		if object.Spec.Name == name {
+			return object, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// CreateSwarmObject creates a config or secret and returns its ID.
+func (self *Portainer) CreateSwarmObject(endpoint *Endpoint, kind string, name string, data []byte, labels map[string]string) (string, error) {
+	return self.CreateSwarmObjectContext(context.Background(), endpoint, kind, name, data, labels)
+}
+
+func (self *Portainer) CreateSwarmObjectContext(ctx context.Context, endpoint *Endpoint, kind string, name string, data []byte, labels map[string]string) (string, error) {
+	if err := swarmKind(kind); err != nil {
+		return "", err
+	}
+
+	r, err := newRequest("POST", fmt.Sprintf("%s/api/endpoints/%d/docker/%s/create", self.address, endpoint.Id, kind), &struct {
+		Name   string            `json:"Name"`
+		Labels map[string]string `json:"Labels,omitempty"`
+		Data   []byte            `json:"Data"`
+	}{
+		Name:   name,
+		Labels: labels,
+		Data:   data,
+	})
+	if err != nil {
+		return "", err
+	}
+	r.applied = func() (bool, error) {
+		object, err := self.GetSwarmObjectByNameContext(ctx, endpoint, kind, name)
+		return object != nil, err
+	}
+
+	var created struct {
+		ID string `json:"ID"`
+	}
+
+	if err := self.send(ctx, r, &created); err != nil {
+		return "", err
+	}
+
+	// an earlier attempt created the object
+	if created.ID == "" {
+		object, err := self.GetSwarmObjectByNameContext(ctx, endpoint, kind, name)
+		if err != nil {
+			return "", err
+		}
+		if object == nil {
+			return "", fmt.Errorf("Swarm %s \"%s\" not found after creation", kind, name)
+		}
+		return object.ID, nil
+	}
+
+	return created.ID, nil
+}
+
+func (self *Portainer) DeleteSwarmObject(endpoint *Endpoint, kind string, id string) error {
+	return self.DeleteSwarmObjectContext(context.Background(), endpoint, kind, id)
+}
+
+func (self *Portainer) DeleteSwarmObjectContext(ctx context.Context, endpoint *Endpoint, kind string, id string) error {
+	if err := swarmKind(kind); err != nil {
+		return err
+	}
+
+	return self.dockerDo(ctx, endpoint, "DELETE", fmt.Sprintf("%s/%s", kind, id), nil, nil)
+}
@@ -0,0 +1,85 @@
+package portainer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// TLSOptions configures how the Portainer server is verified and which client
+// certificate is presented. CA, Cert and Key are PEM data or paths to PEM files.
+type TLSOptions struct {
+	Insecure   bool
+	CA         string
+	Cert       string
+	Key        string
+	MinVersion string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (self *TLSOptions) config() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: self.Insecure}
+
+	if self.MinVersion != "" {
+		version, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(self.MinVersion), "tls")]
+		if !ok {
+			return nil, fmt.Errorf("Unknown TLS version \"%s\"", self.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if self.CA != "" {
+		data, err := readPEM(self.CA)
+		if err != nil {
+			return nil, fmt.Errorf("CA bundle reading error : %s", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("CA bundle contains no certificates")
+		}
+		config.RootCAs = pool
+	}
+
+	if self.Cert != "" || self.Key != "" {
+		if self.Cert == "" || self.Key == "" {
+			return nil, fmt.Errorf("Client certificate and key must be set together")
+		}
+
+		cert, err := readPEM(self.Cert)
+		if err != nil {
+			return nil, fmt.Errorf("Client certificate reading error : %s", err)
+		}
+		key, err := readPEM(self.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Client key reading error : %s", err)
+		}
+
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("Client certificate parsing error : %s", err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+
+	return config, nil
+}
+
+// readPEM returns PEM data given inline or the content of the file it names.
+func readPEM(value string) ([]byte, error) {
+	if strings.Contains(value, "-----BEGIN") {
+		return []byte(value), nil
+	}
+	return ioutil.ReadFile(value)
+}
@@ -0,0 +1,108 @@
+package portainer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a self-signed certificate and its key, PEM encoded.
+func testCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "portainer"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+// PEM values are read inline or from files, incomplete or invalid ones are errors.
+func TestTLSConfig(t *testing.T) {
+	cert, key := testCertificate(t)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	for file, data := range map[string]string{certFile: cert, keyFile: key} {
+		if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		options TLSOptions
+		version uint16
+		certs   int
+		ca      bool
+		err     string
+	}{
+		{name: "defaults"},
+		{name: "min version", options: TLSOptions{MinVersion: "1.2"}, version: tls.VersionTLS12},
+		{name: "min version prefixed", options: TLSOptions{MinVersion: "TLS1.3"}, version: tls.VersionTLS13},
+		{name: "unknown min version", options: TLSOptions{MinVersion: "1.4"}, err: "Unknown TLS version"},
+		{name: "ssl version", options: TLSOptions{MinVersion: "ssl3"}, err: "Unknown TLS version"},
+		{name: "inline CA", options: TLSOptions{CA: cert}, ca: true},
+		{name: "CA file", options: TLSOptions{CA: certFile}, ca: true},
+		{name: "missing CA file", options: TLSOptions{CA: filepath.Join(dir, "missing.pem")}, err: "CA bundle reading error"},
+		{name: "invalid CA", options: TLSOptions{CA: "-----BEGIN CERTIFICATE-----\nbm90IGEgY2VydA==\n-----END CERTIFICATE-----\n"}, err: "CA bundle contains no certificates"},
+		{name: "CA without certificates", options: TLSOptions{CA: keyFile}, err: "CA bundle contains no certificates"},
+		{name: "inline client certificate", options: TLSOptions{Cert: cert, Key: key}, certs: 1},
+		{name: "client certificate files", options: TLSOptions{Cert: certFile, Key: keyFile}, certs: 1},
+		{name: "certificate without key", options: TLSOptions{Cert: cert}, err: "must be set together"},
+		{name: "key without certificate", options: TLSOptions{Key: keyFile}, err: "must be set together"},
+		{name: "swapped certificate and key", options: TLSOptions{Cert: keyFile, Key: certFile}, err: "Client certificate parsing error"},
+		{name: "missing key file", options: TLSOptions{Cert: cert, Key: filepath.Join(dir, "missing.pem")}, err: "Client key reading error"},
+	}
+
+	for _, tt := range tests {
+		config, err := tt.options.config()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("config() %s error = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("config() %s error = %v", tt.name, err)
+			continue
+		}
+
+		if config.MinVersion != tt.version {
+			t.Errorf("config() %s MinVersion = %x, want %x", tt.name, config.MinVersion, tt.version)
+		}
+		if len(config.Certificates) != tt.certs {
+			t.Errorf("config() %s has %d client certificates, want %d", tt.name, len(config.Certificates), tt.certs)
+		}
+		if (config.RootCAs != nil) != tt.ca {
+			t.Errorf("config() %s RootCAs set = %v, want %v", tt.name, config.RootCAs != nil, tt.ca)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Logger creates the logger of the plugin, writing to w in the configured format and
+// level. Secret values are masked in every message and attribute.
+func (p Plugin) Logger(w io.Writer) (*slog.Logger, error) {
+	level := slog.LevelInfo
+	if p.Config.Log.Level != "" {
+		if err := level.UnmarshalText([]byte(p.Config.Log.Level)); err != nil {
+			return nil, fmt.Errorf("Unknown log level \"%s\"", p.Config.Log.Level)
+		}
+	}
+	if p.Config.Debug {
+		level = slog.LevelDebug
+	}
+
+	redact, err := p.redactor()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr(redact)}
+	switch p.Config.Log.Format {
+	case "", LogFormatText:
+		return slog.New(&textHandler{w: w, mu: &sync.Mutex{}, opts: opts}), nil
+	case LogFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+
+	return nil, fmt.Errorf("Unknown log format \"%s\"", p.Config.Log.Format)
+}
+
+// redactAttr masks secret values in string and error attributes.
+func redactAttr(redact func(string) string) func([]string, slog.Attr) slog.Attr {
+	return func(groups []string, a slog.Attr) slog.Attr {
+		switch v := a.Value.Resolve(); v.Kind() {
+		case slog.KindString:
+			return slog.String(a.Key, redact(v.String()))
+		case slog.KindAny:
+			if err, ok := v.Any().(error); ok {
+				return slog.String(a.Key, redact(err.Error()))
+			}
+		}
+		return a
+	}
+}
+
+// stackLogger adds the stack and its endpoint to the events of an action.
+func stackLogger(log *slog.Logger, s Stack) *slog.Logger {
+	if s.Name != "" {
+		log = log.With("stack", s.Name)
+	}
+	if s.Endpoint != "" {
+		log = log.With("endpoint", s.Endpoint)
+	}
+	return log
+}
+
+// phase is a step of an action, logged as a single event with its result and
+// duration once it ends.
+type phase struct {
+	log   *slog.Logger
+	msg   string
+	start time.Time
+}
+
+func begin(log *slog.Logger, name string, msg string, args ...any) *phase {
+	return &phase{
+		log:   log.With(append([]any{"phase", name}, args...)...),
+		msg:   msg,
+		start: time.Now(),
+	}
+}
+
+func (ph *phase) ok(args ...any) {
+	ph.log.Info(ph.msg, append([]any{"result", "ok", "duration", ph.duration()}, args...)...)
+}
+
+// fail logs the phase as failed and returns err.
+func (ph *phase) fail(err error) error {
+	ph.log.Error(ph.msg, "result", "fail", "duration", ph.duration(), "error", err)
+	return err
+}
+
+// skip logs a failed phase which does not fail the action.
+func (ph *phase) skip(err error) {
+	ph.log.Warn(ph.msg, "result", "skip", "duration", ph.duration(), "error", err)
+}
+
+func (ph *phase) duration() time.Duration {
+	return time.Since(ph.start).Round(time.Millisecond)
+}
+
+// textHandler writes records as "message key=value ..." lines for the build log,
+// which is timestamped by the runner. Multi-line values such as diffs follow the
+// line as they are.
+type textHandler struct {
+	w      io.Writer
+	mu     *sync.Mutex
+	opts   *slog.HandlerOptions
+	attrs  []slog.Attr
+	prefix string
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.opts.Level.Level()
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, a := range attrs {
+		c.attrs = append(c.attrs, slog.Attr{Key: h.prefix + a.Key, Value: a.Value})
+	}
+	return &c
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	c := *h
+	c.prefix = h.prefix + name + "."
+	return &c
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	var line, blocks strings.Builder
+
+	if r.Level != slog.LevelInfo {
+		line.WriteString(r.Level.String())
+		line.WriteString(" ")
+	}
+	line.WriteString(h.replace(slog.String(slog.MessageKey, r.Message)).Value.String())
+
+	write := func(a slog.Attr) {
+		a = h.replace(a)
+		if a.Key == "" {
+			return
+		}
+
+		v := a.Value.Resolve().String()
+		if strings.Contains(v, "\n") {
+			blocks.WriteString(strings.TrimRight(v, "\n"))
+			blocks.WriteString("\n")
+			return
+		}
+		if v == "" || strings.ContainsAny(v, " \"=\t") {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(&line, " %s=%s", a.Key, v)
+	}
+
+	for _, a := range h.attrs {
+		write(a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		write(slog.Attr{Key: h.prefix + a.Key, Value: a.Value})
+		return true
+	})
+	line.WriteString("\n")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, line.String()+blocks.String())
+	return err
+}
+
+func (h *textHandler) replace(a slog.Attr) slog.Attr {
+	if h.opts.ReplaceAttr == nil {
+		return a
+	}
+	return h.opts.ReplaceAttr(nil, a)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maniack/drone-portainer/lib/portainer"
+)
+
+// Secrets with characters JSON escapes must not show up in any form in the log.
+func TestLoggerRedactsEscapedSecrets(t *testing.T) {
+	t.Setenv("DB_PASSWORD", "p&ss<word>")
+	t.Setenv("CERT", "line1\nline2")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Id":1,"Name":"web","Env":[{"name":"DB_PASSWORD","value":"p&ss<word>"},{"name":"CERT","value":"line1\nline2"}]}`))
+	}))
+	defer srv.Close()
+
+	for _, format := range []string{LogFormatText, LogFormatJSON} {
+		p := Plugin{Config: Config{
+			Secrets: []string{"DB_PASSWORD", "CERT"},
+			Log:     Log{Format: format},
+			Debug:   true,
+		}}
+
+		var out bytes.Buffer
+		log, err := p.Logger(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env, err := secretEnv(p.Config.Secrets)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		prtnr, err := portainer.NewPortainer(srv.URL, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prtnr.SetLogger(log)
+
+		stack := &portainer.Stack{Id: 1, Name: "web", EndpointID: 1}
+		if err := prtnr.UpdateStackFromString(stack, "services: {}", false, env...); err != nil {
+			t.Fatal(err)
+		}
+		log.Info("Stack file", "file", "password: p&ss<word>\ncert: line1\nline2\n")
+
+		for _, leak := range []string{"p&ss", `p\u0026ss`, "ss<word", `\u003cword`, "line1", "line2"} {
+			if strings.Contains(out.String(), leak) {
+				t.Errorf("%s log contains %q:\n%s", format, leak, out.String())
+			}
+		}
+	}
+}
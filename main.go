@@ -3,9 +3,11 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/codegangsta/cli"
 	_ "github.com/joho/godotenv/autoload"
+	"github.com/maniack/drone-portainer/lib/portainer"
 )
 
 var version string // build number set at compile-time
@@ -89,6 +91,11 @@ func main() {
 			Usage:  "git commit branch",
 			EnvVar: "DRONE_COMMIT_BRANCH",
 		},
+		cli.StringFlag{
+			Name:   "commit.source_branch",
+			Usage:  "git source branch of pull request",
+			EnvVar: "DRONE_SOURCE_BRANCH",
+		},
 		cli.StringFlag{
 			Name:   "commit.message",
 			Usage:  "git commit message",
@@ -151,6 +158,11 @@ func main() {
 			Value:  "success",
 			EnvVar: "DRONE_BUILD_STATUS",
 		},
+		cli.IntFlag{
+			Name:   "build.pull_request",
+			Usage:  "pull request number",
+			EnvVar: "DRONE_PULL_REQUEST",
+		},
 		cli.StringFlag{
 			Name:   "build.link",
 			Usage:  "build link",
@@ -198,17 +210,40 @@ func main() {
 
 		cli.BoolFlag{
 			Name:   "debug",
-			Usage:  "debug mode",
+			Usage:  "debug mode, logs every portainer API request",
 			EnvVar: "PLUGIN_DEBUG",
 		},
+		cli.StringFlag{
+			Name:   "log.format",
+			Usage:  "log format (text, json)",
+			EnvVar: "PLUGIN_LOG_FORMAT,LOG_FORMAT",
+			Value:  "text",
+		},
+		cli.StringFlag{
+			Name:   "log.level",
+			Usage:  "log level (debug, info, warn, error)",
+			EnvVar: "PLUGIN_LOG_LEVEL,LOG_LEVEL",
+			Value:  "info",
+		},
+		cli.StringFlag{
+			Name:   "action",
+			Usage:  "plugin action (deploy, remove, start, stop, sweep, migrate)",
+			EnvVar: "PLUGIN_ACTION,ACTION",
+			Value:  "deploy",
+		},
+		cli.BoolFlag{
+			Name:   "dry-run",
+			Usage:  "show changes without deploying",
+			EnvVar: "PLUGIN_DRY_RUN,DRY_RUN",
+		},
 		cli.StringSliceFlag{
 			Name:   "secrets",
-			Usage:  "plugin secret",
+			Usage:  "environment variables passed to stack environment",
 			EnvVar: "PLUGIN_SECRETS",
 		},
 		cli.StringFlag{
 			Name:   "portainer.address",
-			Usage:  "portainer server address",
+			Usage:  "portainer server address (http://, https:// or unix://)",
 			EnvVar: "PLUGIN_PORTAINER_ADDRESS,PLUGIN_PORTAINER,PLUGIN_ADDRESS,PORTAINER_ADDRESS",
 		},
 		cli.BoolFlag{
@@ -216,9 +251,62 @@ func main() {
 			Usage:  "portainer insecure connection",
 			EnvVar: "PLUGIN_PORTAINER_INSECURE,PLUGIN_INSECURE,PORTAINER_INSECURE",
 		},
+		cli.StringFlag{
+			Name:   "portainer.proxy",
+			Usage:  "proxy used to reach portainer (default from HTTPS_PROXY)",
+			EnvVar: "PLUGIN_PORTAINER_PROXY,PLUGIN_PROXY,PORTAINER_PROXY",
+		},
+		cli.StringFlag{
+			Name:   "portainer.interface",
+			Usage:  "network interface or local address used to reach portainer",
+			EnvVar: "PLUGIN_PORTAINER_INTERFACE,PLUGIN_INTERFACE,PORTAINER_INTERFACE",
+		},
+		cli.StringFlag{
+			Name:   "portainer.ca",
+			Usage:  "portainer CA bundle (PEM or file path)",
+			EnvVar: "PLUGIN_PORTAINER_CA,PLUGIN_CA,PORTAINER_CA",
+		},
+		cli.StringFlag{
+			Name:   "portainer.cert",
+			Usage:  "portainer client certificate (PEM or file path)",
+			EnvVar: "PLUGIN_PORTAINER_CERT,PLUGIN_CERT,PORTAINER_CERT",
+		},
+		cli.StringFlag{
+			Name:   "portainer.key",
+			Usage:  "portainer client key (PEM or file path)",
+			EnvVar: "PLUGIN_PORTAINER_KEY,PLUGIN_KEY,PORTAINER_KEY",
+		},
+		cli.StringFlag{
+			Name:   "portainer.tls_min_version",
+			Usage:  "minimum TLS version (1.0, 1.1, 1.2, 1.3)",
+			EnvVar: "PLUGIN_PORTAINER_TLS_MIN_VERSION,PLUGIN_TLS_MIN_VERSION,PORTAINER_TLS_MIN_VERSION",
+		},
+		cli.IntFlag{
+			Name:   "portainer.retries",
+			Usage:  "portainer request retries on transient failures",
+			EnvVar: "PLUGIN_PORTAINER_RETRIES,PLUGIN_RETRIES,PORTAINER_RETRIES",
+			Value:  3,
+		},
+		cli.DurationFlag{
+			Name:   "portainer.timeout.connect",
+			Usage:  "portainer connection timeout",
+			EnvVar: "PLUGIN_PORTAINER_CONNECT_TIMEOUT,PLUGIN_CONNECT_TIMEOUT,PORTAINER_CONNECT_TIMEOUT",
+			Value:  portainer.DefaultConnectTimeout,
+		},
+		cli.DurationFlag{
+			Name:   "portainer.timeout.request",
+			Usage:  "portainer request timeout",
+			EnvVar: "PLUGIN_PORTAINER_REQUEST_TIMEOUT,PLUGIN_REQUEST_TIMEOUT,PORTAINER_REQUEST_TIMEOUT",
+			Value:  portainer.DefaultRequestTimeout,
+		},
+		cli.DurationFlag{
+			Name:   "timeout",
+			Usage:  "overall plugin timeout",
+			EnvVar: "PLUGIN_TIMEOUT,TIMEOUT",
+		},
 		cli.StringFlag{
 			Name:   "portainer.endpoint",
-			Usage:  "portainer endpoint name",
+			Usage:  "portainer endpoint name or selector (id:, name:, regex:, tag:, group:, url:)",
 			EnvVar: "PLUGIN_PORTAINER_ENDPOINT,PLUGIN_ENDPOINT,PORTAINER_ENDPOINT",
 			Value:  "local",
 		},
@@ -228,12 +316,56 @@ func main() {
 			EnvVar: "PLUGIN_STACK_NAME,PLUGIN_STACK,STACK_NAME",
 			Value:  "stack",
 		},
+		cli.StringFlag{
+			Name:   "stacks",
+			Usage:  "list of stacks to deploy (json)",
+			EnvVar: "PLUGIN_STACKS,STACKS",
+		},
+		cli.IntFlag{
+			Name:   "stacks.parallel",
+			Usage:  "number of stacks deployed in parallel",
+			EnvVar: "PLUGIN_STACKS_PARALLEL,PLUGIN_PARALLEL,STACKS_PARALLEL",
+			Value:  1,
+		},
+		cli.StringFlag{
+			Name:   "stack.conflict",
+			Usage:  "handling of a stack with the same name on another endpoint (error, adopt, migrate)",
+			EnvVar: "PLUGIN_STACK_CONFLICT,PLUGIN_CONFLICT,STACK_CONFLICT",
+			Value:  "error",
+		},
+		cli.StringFlag{
+			Name:   "stack.type",
+			Usage:  "stack type (auto, swarm, compose, kubernetes)",
+			EnvVar: "PLUGIN_STACK_TYPE,STACK_TYPE",
+			Value:  "auto",
+		},
 		cli.StringFlag{
 			Name:   "stack.file",
 			Usage:  "stack file path",
 			EnvVar: "PLUGIN_STACK_FILE,PLUGIN_FILE,STACK_FILE",
 			Value:  "docker-compose.yml",
 		},
+		cli.StringFlag{
+			Name:   "stack.namespace",
+			Usage:  "kubernetes stack namespace",
+			EnvVar: "PLUGIN_STACK_NAMESPACE,PLUGIN_NAMESPACE,STACK_NAMESPACE",
+			Value:  "default",
+		},
+		cli.BoolFlag{
+			Name:   "stack.kompose",
+			Usage:  "kubernetes stack file is in compose format",
+			EnvVar: "PLUGIN_STACK_KOMPOSE,PLUGIN_KOMPOSE,STACK_KOMPOSE",
+		},
+		cli.StringSliceFlag{
+			Name:   "stack.files",
+			Usage:  "stack file paths merged in order",
+			EnvVar: "PLUGIN_STACK_FILES,PLUGIN_FILES,STACK_FILES",
+		},
+		cli.BoolFlag{
+			Name:   "stack.print",
+			Usage:  "print stack file sent to portainer",
+			EnvVar: "PLUGIN_STACK_PRINT,PLUGIN_PRINT,STACK_PRINT",
+		},
 		cli.StringSliceFlag{
 			Name:   "stack.config",
 			Usage:  "stack config",
@@ -244,6 +376,142 @@ func main() {
 			Usage:  "stack environment",
 			EnvVar: "PLUGIN_STACK_ENVIRONMENT,PLUGIN_STACK_ENV,PLUGIN_ENVIRONMENT,PLUGIN_ENV,STACK_ENVIRONMENT,STACK_ENV",
 		},
+		cli.BoolFlag{
+			Name:   "stack.template",
+			Usage:  "render stack file as template with build metadata",
+			EnvVar: "PLUGIN_STACK_TEMPLATE,PLUGIN_TEMPLATE,STACK_TEMPLATE",
+		},
+		cli.BoolFlag{
+			Name:   "stack.template.strict",
+			Usage:  "fail on undefined template variables",
+			EnvVar: "PLUGIN_STACK_TEMPLATE_STRICT,PLUGIN_TEMPLATE_STRICT,STACK_TEMPLATE_STRICT",
+		},
+		cli.BoolFlag{
+			Name:   "stack.rotate",
+			Usage:  "rotate stack configs and secrets by content hash",
+			EnvVar: "PLUGIN_STACK_ROTATE,PLUGIN_ROTATE,STACK_ROTATE",
+		},
+		cli.IntFlag{
+			Name:   "stack.rotate.retention",
+			Usage:  "number of rotated config and secret versions to keep",
+			EnvVar: "PLUGIN_STACK_ROTATE_RETENTION,PLUGIN_ROTATE_RETENTION,STACK_ROTATE_RETENTION",
+			Value:  3,
+		},
+		cli.BoolFlag{
+			Name:   "stack.rollback",
+			Usage:  "roll back stack to previous version on failure",
+			EnvVar: "PLUGIN_STACK_ROLLBACK,PLUGIN_ROLLBACK,STACK_ROLLBACK",
+		},
+		cli.BoolFlag{
+			Name:   "stack.wait",
+			Usage:  "wait for stack services to converge",
+			EnvVar: "PLUGIN_STACK_WAIT,PLUGIN_WAIT,STACK_WAIT",
+		},
+		cli.DurationFlag{
+			Name:   "stack.wait.timeout",
+			Usage:  "stack rollout timeout",
+			EnvVar: "PLUGIN_STACK_WAIT_TIMEOUT,PLUGIN_WAIT_TIMEOUT,STACK_WAIT_TIMEOUT",
+			Value:  5 * time.Minute,
+		},
+		cli.DurationFlag{
+			Name:   "stack.wait.interval",
+			Usage:  "stack rollout polling interval",
+			EnvVar: "PLUGIN_STACK_WAIT_INTERVAL,PLUGIN_WAIT_INTERVAL,STACK_WAIT_INTERVAL",
+			Value:  5 * time.Second,
+		},
+		cli.StringFlag{
+			Name:   "git.url",
+			Usage:  "stack git repository url",
+			EnvVar: "PLUGIN_GIT_URL,PLUGIN_REPOSITORY,GIT_URL",
+		},
+		cli.StringFlag{
+			Name:   "git.reference",
+			Usage:  "stack git repository reference",
+			EnvVar: "PLUGIN_GIT_REFERENCE,PLUGIN_GIT_REF,PLUGIN_REFERENCE,GIT_REFERENCE",
+		},
+		cli.StringFlag{
+			Name:   "git.path",
+			Usage:  "stack compose file path in git repository",
+			EnvVar: "PLUGIN_GIT_PATH,PLUGIN_GIT_FILE,GIT_PATH",
+			Value:  "docker-compose.yml",
+		},
+		cli.StringSliceFlag{
+			Name:   "git.files",
+			Usage:  "stack additional files in git repository",
+			EnvVar: "PLUGIN_GIT_FILES,PLUGIN_GIT_ADDITIONAL_FILES,GIT_FILES",
+		},
+		cli.StringFlag{
+			Name:   "git.username",
+			Usage:  "stack git repository username",
+			EnvVar: "PLUGIN_GIT_USERNAME,GIT_USERNAME",
+		},
+		cli.StringFlag{
+			Name:   "git.password",
+			Usage:  "stack git repository password",
+			EnvVar: "PLUGIN_GIT_PASSWORD,GIT_PASSWORD",
+		},
+		cli.BoolFlag{
+			Name:   "git.pull",
+			Usage:  "pull images on git redeploy",
+			EnvVar: "PLUGIN_GIT_PULL,PLUGIN_PULL_IMAGE,GIT_PULL",
+		},
+		cli.BoolTFlag{
+			Name:   "git.prune",
+			Usage:  "prune services on git redeploy",
+			EnvVar: "PLUGIN_GIT_PRUNE,GIT_PRUNE",
+		},
+		cli.BoolFlag{
+			Name:   "stack.remove.volumes",
+			Usage:  "remove stack volumes with the stack",
+			EnvVar: "PLUGIN_STACK_REMOVE_VOLUMES,PLUGIN_REMOVE_VOLUMES,STACK_REMOVE_VOLUMES",
+		},
+		cli.BoolFlag{
+			Name:   "stack.remove.networks",
+			Usage:  "remove stack networks with the stack",
+			EnvVar: "PLUGIN_STACK_REMOVE_NETWORKS,PLUGIN_REMOVE_NETWORKS,STACK_REMOVE_NETWORKS",
+		},
+		cli.StringFlag{
+			Name:   "migrate.endpoint",
+			Usage:  "endpoint the stack is migrated to",
+			EnvVar: "PLUGIN_MIGRATE_ENDPOINT,PLUGIN_TARGET_ENDPOINT,MIGRATE_ENDPOINT",
+		},
+		cli.StringFlag{
+			Name:   "migrate.name",
+			Usage:  "new name of the migrated stack",
+			EnvVar: "PLUGIN_MIGRATE_NAME,MIGRATE_NAME",
+		},
+		cli.BoolFlag{
+			Name:   "preview",
+			Usage:  "deploy a preview stack named after the branch or pull request",
+			EnvVar: "PLUGIN_PREVIEW,PREVIEW",
+		},
+		cli.StringFlag{
+			Name:   "preview.prefix",
+			Usage:  "preview stack name prefix",
+			EnvVar: "PLUGIN_PREVIEW_PREFIX,PREVIEW_PREFIX",
+			Value:  "preview",
+		},
+		cli.DurationFlag{
+			Name:   "preview.ttl",
+			Usage:  "age after which sweep removes preview stacks",
+			EnvVar: "PLUGIN_PREVIEW_TTL,PREVIEW_TTL",
+		},
+		cli.StringSliceFlag{
+			Name:   "preview.branches",
+			Usage:  "branches whose preview stacks sweep keeps",
+			EnvVar: "PLUGIN_PREVIEW_BRANCHES,PREVIEW_BRANCHES",
+		},
+		cli.StringSliceFlag{
+			Name:   "stack.env_files",
+			Usage:  "stack environment files",
+			EnvVar: "PLUGIN_STACK_ENV_FILES,PLUGIN_STACK_ENV_FILE,PLUGIN_ENV_FILES,PLUGIN_ENV_FILE,STACK_ENV_FILES",
+		},
+		cli.StringFlag{
+			Name:   "stack.env_policy",
+			Usage:  "stack environment merge policy (replace, keep, add)",
+			EnvVar: "PLUGIN_STACK_ENV_POLICY,PLUGIN_ENV_POLICY,STACK_ENV_POLICY",
+			Value:  "replace",
+		},
 		cli.StringFlag{
 			Name:   "portainer.username",
 			Usage:  "portainer server username",
@@ -254,6 +522,16 @@ func main() {
 			Usage:  "portainer server password",
 			EnvVar: "PLUGIN_PORTAINER_PASSWORD,PLUGIN_PASSWORD,PORTAINER_PASSWORD",
 		},
+		cli.StringFlag{
+			Name:   "portainer.token",
+			Usage:  "portainer server access token",
+			EnvVar: "PLUGIN_PORTAINER_TOKEN,PLUGIN_TOKEN,PORTAINER_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "portainer.jwt",
+			Usage:  "portainer server pre-issued jwt",
+			EnvVar: "PLUGIN_PORTAINER_JWT,PLUGIN_JWT,PORTAINER_JWT",
+		},
 	}
 
 	app.Run(os.Args)
@@ -280,11 +558,13 @@ func run(c *cli.Context) {
 			Started:  int64(c.Int("build.started")),
 			Finished: int64(c.Int("build.finished")),
 			Link:     c.String("build.link"),
+
+			PullRequest: c.Int("build.pull_request"),
 		},
 		Commit: Commit{
 			Remote:  c.String("remote.url"),
 			Sha:     c.String("commit.sha"),
-			Ref:     c.String("commit.sha"),
+			Ref:     c.String("commit.ref"),
 			Link:    c.String("commit.link"),
 			Branch:  c.String("commit.branch"),
 			Message: c.String("commit.message"),
@@ -293,28 +573,101 @@ func run(c *cli.Context) {
 				Email:  c.String("commit.author.email"),
 				Avatar: c.String("commit.author.avatar"),
 			},
+
+			SourceBranch: c.String("commit.source_branch"),
 		},
 		Config: Config{
+			Action: c.String("action"),
 			Portainer: Portainer{
-				Address:  c.String("portainer.address"),
-				Username: c.String("portainer.username"),
-				Password: c.String("portainer.password"),
-				Endpoint: c.String("portainer.endpoint"),
-				Insecure: c.Bool("portainer.insecure"),
+				Address:   c.String("portainer.address"),
+				Username:  c.String("portainer.username"),
+				Password:  c.String("portainer.password"),
+				Token:     c.String("portainer.token"),
+				JWT:       c.String("portainer.jwt"),
+				Endpoint:  c.String("portainer.endpoint"),
+				Insecure:  c.Bool("portainer.insecure"),
+				Proxy:     c.String("portainer.proxy"),
+				Interface: c.String("portainer.interface"),
+				CA:        c.String("portainer.ca"),
+				Cert:      c.String("portainer.cert"),
+				Key:       c.String("portainer.key"),
+				Retries:   c.Int("portainer.retries"),
+
+				ConnectTimeout: c.Duration("portainer.timeout.connect"),
+				RequestTimeout: c.Duration("portainer.timeout.request"),
+				TLSMinVersion:  c.String("portainer.tls_min_version"),
 			},
 			Stack: Stack{
-				Name:        c.String("stack.name"),
-				Path:        c.String("stack.file"),
-				Config:      c.StringSlice("stack.config"),
-				Environment: c.StringSlice("stack.environment"),
+				Name:            c.String("stack.name"),
+				Type:            c.String("stack.type"),
+				Path:            c.String("stack.file"),
+				Files:           c.StringSlice("stack.files"),
+				Print:           c.Bool("stack.print"),
+				Namespace:       c.String("stack.namespace"),
+				Kompose:         c.Bool("stack.kompose"),
+				Conflict:        c.String("stack.conflict"),
+				Config:          c.StringSlice("stack.config"),
+				Environment:     c.StringSlice("stack.environment"),
+				EnvFiles:        c.StringSlice("stack.env_files"),
+				EnvPolicy:       c.String("stack.env_policy"),
+				Template:        c.Bool("stack.template"),
+				TemplateStrict:  c.Bool("stack.template.strict"),
+				Rotate:          c.Bool("stack.rotate"),
+				RotateRetention: c.Int("stack.rotate.retention"),
+				Rollback:        c.Bool("stack.rollback"),
+				RemoveVolumes:   c.Bool("stack.remove.volumes"),
+				RemoveNetworks:  c.Bool("stack.remove.networks"),
+				Wait:            c.Bool("stack.wait"),
+				WaitTimeout:     c.Duration("stack.wait.timeout"),
+				WaitInterval:    c.Duration("stack.wait.interval"),
+			},
+			Parallel: c.Int("stacks.parallel"),
+			Git: Git{
+				URL:       c.String("git.url"),
+				Reference: c.String("git.reference"),
+				Path:      c.String("git.path"),
+				Files:     c.StringSlice("git.files"),
+				Username:  c.String("git.username"),
+				Password:  c.String("git.password"),
+				Pull:      c.Bool("git.pull"),
+				Prune:     c.BoolT("git.prune"),
+			},
+			Preview: Preview{
+				Enabled:  c.Bool("preview"),
+				Prefix:   c.String("preview.prefix"),
+				TTL:      c.Duration("preview.ttl"),
+				Branches: c.StringSlice("preview.branches"),
+			},
+			Migrate: Migrate{
+				Endpoint: c.String("migrate.endpoint"),
+				Name:     c.String("migrate.name"),
 			},
 			Secrets: c.StringSlice("secrets"),
-			Debug:   c.Bool("debug"),
+			DryRun:  c.Bool("dry-run"),
+			Timeout: c.Duration("timeout"),
+			Log: Log{
+				Format: c.String("log.format"),
+				Level:  c.String("log.level"),
+			},
+			Debug: c.Bool("debug"),
 		},
 	}
 
-	if err := plugin.Exec(); err != nil {
+	log, err := plugin.Logger(os.Stdout)
+	if err != nil {
 		fmt.Printf("Exited with error: %v\n", err)
 		os.Exit(1)
 	}
+
+	stacks, err := ParseStacks(c.String("stacks"), plugin.Config.Stack)
+	if err != nil {
+		log.Error("Exited with error", "error", err)
+		os.Exit(1)
+	}
+	plugin.Config.Stacks = stacks
+
+	if err := plugin.Exec(log); err != nil {
+		log.Error("Exited with error", "error", err)
+		os.Exit(1)
+	}
 }
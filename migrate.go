@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/maniack/drone-portainer/lib/portainer"
+)
+
+// migrate moves a stack from its endpoint to the target endpoint, optionally renaming it.
+// A stack which is already on the target endpoint is left alone.
+func (p Plugin) migrate(ctx context.Context, prtnr *portainer.Portainer, s Stack, log *slog.Logger) error {
+	if p.Config.Migrate.Endpoint == "" {
+		return fmt.Errorf("Migration target endpoint not defined")
+	}
+
+	name := s.Name
+	if p.Config.Migrate.Name != "" {
+		name = p.Config.Migrate.Name
+	}
+
+	source, err := p.selectEndpoint(ctx, prtnr, s, log)
+	if err != nil {
+		return err
+	}
+
+	ph := begin(log, "select_target", "Select target endpoint", "selector", p.Config.Migrate.Endpoint)
+	targets, err := prtnr.FindEndpointsContext(ctx, p.Config.Migrate.Endpoint)
+	if err != nil {
+		return ph.fail(err)
+	}
+	if len(targets) > 1 {
+		return ph.fail(fmt.Errorf("Target endpoint \"%s\" matched %d endpoints", p.Config.Migrate.Endpoint, len(targets)))
+	}
+	target, err := prtnr.GetEndpointByIDContext(ctx, targets[0].Id)
+	if err != nil {
+		return ph.fail(err)
+	}
+	ph.ok("target", target.Name)
+
+	if target.Id == source.Id {
+		return fmt.Errorf("Stack \"%s\" can not be migrated to its own endpoint \"%s\"", s.Name, source.Name)
+	}
+
+	ph = begin(log, "search_stack", "Search stack")
+	stack, err := prtnr.GetStackContext(ctx, source, s.Name)
+	if err != nil {
+		return ph.fail(err)
+	}
+	existing, err := prtnr.GetStackContext(ctx, target, name)
+	if err != nil {
+		return ph.fail(err)
+	}
+	if stack == nil && existing != nil {
+		ph.ok("found", false)
+		log.Info("Stack is already on target endpoint, nothing to migrate", "target", target.Name, "name", name)
+		return nil
+	}
+	if stack == nil {
+		return ph.fail(fmt.Errorf("Stack \"%s\" not found on endpoint \"%s\"", s.Name, source.Name))
+	}
+	if existing != nil {
+		return ph.fail(fmt.Errorf("Stack \"%s\" already exists on endpoint \"%s\"", name, target.Name))
+	}
+	ph.ok("found", true, "stack_id", stack.Id)
+
+	switch stack.Type {
+	case portainer.StackTypeSwarm:
+		if target.SwarmID == "" {
+			return fmt.Errorf("Endpoint \"%s\" is not in swarm mode", target.Name)
+		}
+	case portainer.StackTypeKubernetes:
+		return fmt.Errorf("Migration of Kubernetes stack \"%s\" not supported", stack.Name)
+	}
+	target.StackType = stack.Type
+
+	if p.Config.DryRun {
+		log.Info("Stack would be migrated", "source", source.Name, "target", target.Name, "name", name)
+		return nil
+	}
+
+	ph = begin(log, "migrate", "Migrate stack", "source", source.Name, "target", target.Name, "name", name)
+	rename := ""
+	if name != stack.Name {
+		rename = name
+	}
+	err = prtnr.MigrateStackContext(ctx, stack, target, rename)
+	if err != nil {
+		return ph.fail(err)
+	}
+	ph.ok()
+
+	ph = begin(log, "verify", "Verify stack", "target", target.Name, "name", name)
+	migrated, err := prtnr.GetStackContext(ctx, target, name)
+	if err != nil {
+		return ph.fail(err)
+	}
+	if migrated == nil || migrated.Id != stack.Id {
+		return ph.fail(fmt.Errorf("Stack \"%s\" not found on endpoint \"%s\" after migration", name, target.Name))
+	}
+	ph.ok()
+
+	return nil
+}
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/maniack/drone-portainer/lib/portainer"
@@ -28,6 +36,8 @@ type (
 		Started  int64
 		Finished int64
 		Link     string
+
+		PullRequest int
 	}
 
 	Commit struct {
@@ -38,6 +48,8 @@ type (
 		Branch  string
 		Message string
 		Author  Author
+
+		SourceBranch string
 	}
 
 	Author struct {
@@ -47,27 +59,107 @@ type (
 	}
 
 	Portainer struct {
-		Address  string
-		Username string
-		Password string
-		Endpoint string
-		Insecure bool
+		Address   string
+		Username  string
+		Password  string
+		Token     string
+		JWT       string
+		Endpoint  string
+		Insecure  bool
+		Proxy     string
+		Interface string
+		CA        string
+		Cert      string
+		Key       string
+		Retries   int
+
+		ConnectTimeout time.Duration
+		RequestTimeout time.Duration
+		TLSMinVersion  string
 	}
 
 	Stack struct {
-		Name        string
-		Path        string
-		Config      []string
-		Environment []string
+		Name            string
+		Endpoint        string
+		EndpointID      int
+		Type            string
+		Path            string
+		Files           []string
+		Namespace       string
+		Kompose         bool
+		Conflict        string
+		Config          []string
+		Environment     []string
+		EnvFiles        []string
+		EnvPolicy       string
+		Print           bool
+		Template        bool
+		TemplateStrict  bool
+		Rotate          bool
+		RotateRetention int
+		Rollback        bool
+		RemoveVolumes   bool
+		RemoveNetworks  bool
+		Wait            bool
+		WaitTimeout     time.Duration
+		WaitInterval    time.Duration
+	}
+
+	Git struct {
+		URL       string
+		Reference string
+		Path      string
+		Files     []string
+		Username  string
+		Password  string
+		Pull      bool
+		Prune     bool
+	}
+
+	Preview struct {
+		Enabled  bool
+		Prefix   string
+		TTL      time.Duration
+		Branches []string
+	}
+
+	Migrate struct {
+		Endpoint string
+		Name     string
+	}
+
+	Log struct {
+		Format string
+		Level  string
 	}
 
 	Config struct {
+		Action    string
 		Portainer Portainer
 		Stack     Stack
+		Stacks    []Stack
+		Parallel  int
+		Git       Git
+		Preview   Preview
+		Migrate   Migrate
 		Secrets   []string
+		DryRun    bool
+		Timeout   time.Duration
+		Log       Log
 		Debug     bool
 	}
 
+	// StackSpec is a single entry of the stacks setting.
+	StackSpec struct {
+		Name        string   `json:"name"`
+		File        string   `json:"file"`
+		Files       []string `json:"files"`
+		Config      string   `json:"config"`
+		Environment []string `json:"environment"`
+		EnvFiles    []string `json:"env_files"`
+		Endpoint    string   `json:"endpoint"`
+	}
+
 	Plugin struct {
 		Repo   Repo
 		Build  Build
@@ -76,95 +168,323 @@ type (
 	}
 )
 
-func (p Plugin) Exec() error {
-	prtnr, err := portainer.NewPortainer(p.Config.Portainer.Address, p.Config.Portainer.Insecure)
-	if err != nil {
-		return err
+// Authenticator picks the credential strategy from the settings present.
+func (p Portainer) Authenticator() portainer.Authenticator {
+	switch {
+	case p.Token != "":
+		return &portainer.APIKeyAuth{Key: p.Token}
+	case p.JWT != "":
+		return &portainer.TokenAuth{JWT: p.JWT}
+	case p.Username != "" || p.Password != "":
+		return &portainer.PasswordAuth{Username: p.Username, Password: p.Password}
 	}
 
-	fmt.Printf("Connecting to portainer server...")
-	err = prtnr.Connect()
-	if err != nil {
-		fmt.Printf(" FAIL\n")
-		return err
+	return nil
+}
+
+func (p Portainer) TLS() *portainer.TLSOptions {
+	return &portainer.TLSOptions{
+		Insecure:   p.Insecure,
+		CA:         p.CA,
+		Cert:       p.Cert,
+		Key:        p.Key,
+		MinVersion: p.TLSMinVersion,
+	}
+}
+
+func (g Git) Repository() *portainer.GitRepository {
+	return &portainer.GitRepository{
+		URL:             g.URL,
+		Reference:       g.Reference,
+		ComposeFile:     g.Path,
+		AdditionalFiles: g.Files,
+		Username:        g.Username,
+		Password:        g.Password,
+	}
+}
+
+// Exec runs the action until it finishes, the timeout expires or the runner
+// stops the step with SIGTERM.
+func (p Plugin) Exec(log *slog.Logger) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if p.Config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Config.Timeout)
+		defer cancel()
+	}
+
+	err := p.ExecContext(ctx, log)
+	switch {
+	case err == nil:
+		return nil
+	case ctx.Err() == context.DeadlineExceeded:
+		return fmt.Errorf("Timed out after %s: %s", p.Config.Timeout, err)
+	case ctx.Err() != nil:
+		return fmt.Errorf("Interrupted: %s", err)
+	}
+
+	return err
+}
+
+func (p Plugin) ExecContext(ctx context.Context, log *slog.Logger) error {
+	var action func(context.Context, *portainer.Portainer, Stack, *slog.Logger) error
+	switch p.Config.Action {
+	case "", "deploy":
+		action = p.deploy
+	case "remove":
+		action = p.remove
+	case "start":
+		action = p.start
+	case "stop":
+		action = p.stop
+	case "sweep":
+		action = p.sweep
+	case "migrate":
+		action = p.migrate
+	default:
+		return fmt.Errorf("Unknown action \"%s\"", p.Config.Action)
+	}
+
+	// the wait and the removal of stack resources poll at this interval
+	if p.Config.Stack.WaitInterval <= 0 {
+		return fmt.Errorf("Stack wait interval must be positive, got %s", p.Config.Stack.WaitInterval)
+	}
+
+	if p.Config.Preview.Enabled && p.Config.Action != "sweep" {
+		if len(p.Config.Stacks) > 0 {
+			return fmt.Errorf("Preview mode not supported with multiple stacks")
+		}
+
+		name, err := p.previewName()
+		if err != nil {
+			return err
+		}
+		p.Config.Stack.Name = name
+		log.Info("Preview stack", "stack", name)
 	}
-	fmt.Printf(" OK\n")
 
-	fmt.Printf("Autentication...")
-	err = prtnr.Auth(p.Config.Portainer.Username, p.Config.Portainer.Password)
+	prtnr, err := portainer.NewPortainerTLS(p.Config.Portainer.Address, p.Config.Portainer.TLS())
 	if err != nil {
-		fmt.Printf(" FAIL\n")
 		return err
 	}
-	fmt.Printf(" OK\n")
+	prtnr.SetTimeouts(p.Config.Portainer.ConnectTimeout, p.Config.Portainer.RequestTimeout)
+	prtnr.SetLogger(log)
 
-	fmt.Printf("Selecting endpoint \"%s\"...", p.Config.Portainer.Endpoint)
-	endpoint, err := prtnr.GetEndpointByName(p.Config.Portainer.Endpoint)
+	secrets, err := secretEnv(p.Config.Secrets)
 	if err != nil {
-		fmt.Printf(" FAIL\n")
 		return err
 	}
-	fmt.Printf(" OK\n")
+	var names []string
+	for _, e := range secrets {
+		names = append(names, e.Name)
+	}
+	prtnr.SetSecretEnv(names)
 
-	fmt.Printf("Search stack \"%s\"...", p.Config.Stack.Name)
-	stack, err := prtnr.GetStackByName(p.Config.Stack.Name)
-	if err != nil {
-		fmt.Printf(" FAIL\n")
-	} else {
-		fmt.Printf(" OK\n")
+	if p.Config.Portainer.Proxy != "" {
+		if err := prtnr.SetProxy(p.Config.Portainer.Proxy); err != nil {
+			return err
+		}
 	}
+	if p.Config.Portainer.Interface != "" {
+		if err := prtnr.SetInterface(p.Config.Portainer.Interface); err != nil {
+			return err
+		}
+	}
+
+	retry := portainer.DefaultRetryPolicy
+	retry.Attempts = p.Config.Portainer.Retries + 1
+	prtnr.SetRetryPolicy(retry)
 
-	var env []*portainer.Env
-	for _, v := range p.Config.Stack.Environment {
-		e := strings.SplitN(v, "=", 2)
-		env = append(env, &portainer.Env{Name: e[0], Value: e[1]})
+	ph := begin(log, "connect", "Connect to portainer server")
+	if err := prtnr.ConnectContext(ctx); err != nil {
+		return ph.fail(err)
 	}
+	ph.ok()
 
-	var stack_config string
-	if len(p.Config.Stack.Config) > 0 {
-		stack_config = strings.Join(p.Config.Stack.Config, "\n")
+	ph = begin(log, "authenticate", "Authenticate")
+	if err := prtnr.AuthenticateContext(ctx, p.Config.Portainer.Authenticator()); err != nil {
+		return ph.fail(err)
 	}
-	_ = stack_config
+	ph.ok()
 
-	start := time.Now()
+	stacks := p.Config.Stacks
+	if len(stacks) == 0 {
+		stacks = []Stack{p.Config.Stack}
+	}
 
-	if stack != nil && stack.EndpointID == endpoint.Id {
-		fmt.Printf("Updating stack \"%s\"...", stack.Name)
-		if stack_config != "" {
-			err := prtnr.UpdateStackFromString(stack, stack_config, true, env...)
+	stacks, err = p.expandEndpoints(ctx, prtnr, stacks, log)
+	if err != nil {
+		return err
+	}
+
+	if len(p.Config.Stacks) == 0 && len(stacks) == 1 {
+		return action(ctx, prtnr, stacks[0], stackLogger(log, stacks[0]))
+	}
+
+	return p.runAll(ctx, prtnr, stacks, action, log)
+}
+
+// expandEndpoints resolves the endpoint selector of each stack and repeats the
+// stack for every endpoint it matches.
+func (p Plugin) expandEndpoints(ctx context.Context, prtnr *portainer.Portainer, stacks []Stack, log *slog.Logger) ([]Stack, error) {
+	resolved := map[string][]*portainer.Endpoint{}
+
+	var expanded []Stack
+	for _, s := range stacks {
+		if s.EndpointID != 0 {
+			expanded = append(expanded, s)
+			continue
+		}
+
+		selector := s.Endpoint
+		if selector == "" {
+			selector = p.Config.Portainer.Endpoint
+		}
+
+		endpoints, ok := resolved[selector]
+		if !ok {
+			ph := begin(log, "resolve_endpoint", "Resolve endpoint", "selector", selector)
+			var err error
+			endpoints, err = prtnr.FindEndpointsContext(ctx, selector)
 			if err != nil {
-				fmt.Printf(" FAIL\n")
-				return err
+				return nil, ph.fail(err)
 			}
-		} else {
-			err := prtnr.UpdateStackFromFile(stack, p.Config.Stack.Path, true, env...)
-			if err != nil {
-				fmt.Printf(" FAIL\n")
-				return err
+
+			var names []string
+			for _, e := range endpoints {
+				names = append(names, e.Name)
 			}
+			ph.ok("endpoints", strings.Join(names, ","))
+			resolved[selector] = endpoints
 		}
-		fmt.Printf(" OK\n")
-		fmt.Printf("Update stack \"%s\" finished in %s\n", p.Config.Stack.Name, time.Since(start))
-	} else {
-		fmt.Printf("Depploy stack \"%s\"...", p.Config.Stack.Name)
-		if stack_config != "" {
-			err := prtnr.DeployStackFromString(endpoint, p.Config.Stack.Name, stack_config, env...)
-			if err != nil {
-				fmt.Printf(" FAIL\n")
-				return err
+
+		for _, e := range endpoints {
+			s.Endpoint = e.Name
+			s.EndpointID = e.Id
+			expanded = append(expanded, s)
+		}
+	}
+
+	return expanded, nil
+}
+
+// ParseStacks reads the stacks setting, a JSON list of stack definitions.
+// Fields missing from a definition are taken from the defaults.
+func ParseStacks(data string, defaults Stack) ([]Stack, error) {
+	if strings.TrimSpace(data) == "" {
+		return nil, nil
+	}
+
+	var specs []StackSpec
+	if err := json.Unmarshal([]byte(data), &specs); err != nil {
+		return nil, fmt.Errorf("Stacks parsing error : %s", err)
+	}
+
+	var stacks []Stack
+	for i, spec := range specs {
+		if spec.Name == "" {
+			return nil, fmt.Errorf("Stack #%d name not defined", i+1)
+		}
+
+		s := defaults
+		s.Name = spec.Name
+		if spec.Endpoint != "" {
+			s.Endpoint = spec.Endpoint
+		}
+		if spec.File != "" {
+			s.Path = spec.File
+			s.Files = nil
+			s.Config = nil
+		}
+		if len(spec.Files) > 0 {
+			s.Files = spec.Files
+			s.Config = nil
+		}
+		if spec.Config != "" {
+			s.Config = []string{spec.Config}
+		}
+		s.Environment = append(append([]string{}, defaults.Environment...), spec.Environment...)
+		s.EnvFiles = append(append([]string{}, defaults.EnvFiles...), spec.EnvFiles...)
+
+		stacks = append(stacks, s)
+	}
+
+	return stacks, nil
+}
+
+// runAll runs the action on several stacks, up to Parallel at a time, and logs a summary.
+// Every event carries the stack and endpoint it belongs to.
+func (p Plugin) runAll(ctx context.Context, prtnr *portainer.Portainer, stacks []Stack, action func(context.Context, *portainer.Portainer, Stack, *slog.Logger) error, log *slog.Logger) error {
+	type result struct {
+		endpoint string
+		duration time.Duration
+		err      error
+	}
+
+	limit := p.Config.Parallel
+	if limit < 1 {
+		limit = 1
+	}
+
+	var (
+		results = make([]result, len(stacks))
+		sem     = make(chan struct{}, limit)
+		wg      sync.WaitGroup
+	)
+
+	for i, s := range stacks {
+		if s.Endpoint == "" {
+			s.Endpoint = p.Config.Portainer.Endpoint
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, s Stack) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			log := stackLogger(log, s)
+			ph := begin(log, "stack", "Stack finished")
+			if err := ctx.Err(); err != nil {
+				results[i].err = err
+			} else {
+				results[i].err = action(ctx, prtnr, s, log)
 			}
-		} else if p.Config.Stack.Path != "" {
-			err := prtnr.DeployStackFromFile(endpoint, p.Config.Stack.Name, p.Config.Stack.Path, env...)
-			if err != nil {
-				fmt.Printf(" FAIL\n")
-				return err
+			if results[i].err != nil {
+				ph.fail(results[i].err)
+			} else {
+				ph.ok()
+			}
+			results[i].endpoint = s.Endpoint
+			results[i].duration = ph.duration()
+		}(i, s)
+	}
+	wg.Wait()
+
+	failed := 0
+	for i := range stacks {
+		if results[i].err != nil {
+			failed++
+		}
+	}
+
+	if p.Config.Log.Format != LogFormatJSON {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "\nSTACK\tENDPOINT\tRESULT\tDURATION\n")
+		for i, s := range stacks {
+			status := "OK"
+			if results[i].err != nil {
+				status = "FAIL"
 			}
-		} else {
-			fmt.Printf(" FAIL\n")
-			return fmt.Errorf("Stack config not defined")
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Name, results[i].endpoint, status, results[i].duration)
 		}
-		fmt.Printf(" OK\n")
-		fmt.Printf("Deploy stack %s finished in %s\n", p.Config.Stack.Name, time.Since(start))
+		w.Flush()
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d stacks failed", failed, len(stacks))
 	}
 
 	return nil
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/maniack/drone-portainer/lib/portainer"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	PreviewBranchLabel = "drone.preview.branch"
+	PreviewCommitLabel = "drone.preview.commit"
+	PreviewBuildLabel  = "drone.preview.build"
+)
+
+// previewNameMax keeps preview names well below the limits of the
+// resource names Docker derives from them.
+const previewNameMax = 50
+
+var (
+	previewInvalid = regexp.MustCompile(`[^a-z0-9_-]+`)
+	previewDashes  = regexp.MustCompile(`-{2,}`)
+)
+
+// sanitize turns a string into a valid stack name: lower case letters, digits,
+// dashes and underscores, starting and ending with a letter or digit.
+func sanitize(name string) string {
+	name = previewInvalid.ReplaceAllString(strings.ToLower(name), "-")
+	name = previewDashes.ReplaceAllString(name, "-")
+	name = strings.Trim(name, "-_")
+	if len(name) > previewNameMax {
+		name = strings.TrimRight(name[:previewNameMax], "-_")
+	}
+	return name
+}
+
+// previewName is the stack name of the preview environment of the current build:
+// <prefix>-pr-<number> for pull requests, <prefix>-<branch> otherwise.
+func (p Plugin) previewName() (string, error) {
+	if p.Build.Event == "pull_request" && p.Build.PullRequest > 0 {
+		return sanitize(fmt.Sprintf("%s-pr-%d", p.Config.Preview.Prefix, p.Build.PullRequest)), nil
+	}
+
+	branch := p.Commit.SourceBranch
+	if branch == "" {
+		branch = p.Commit.Branch
+	}
+	if sanitize(branch) == "" {
+		return "", fmt.Errorf("Preview branch not defined")
+	}
+
+	return sanitize(fmt.Sprintf("%s-%s", p.Config.Preview.Prefix, branch)), nil
+}
+
+// previewLabels adds the branch, commit and build labels to every service of the stack file.
+func (p Plugin) previewLabels(config string, swarm bool) (string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(config), &doc); err != nil {
+		return "", fmt.Errorf("Stack file parsing error : %s", err)
+	}
+	if len(doc.Content) == 0 {
+		return config, nil
+	}
+
+	branch := p.Commit.SourceBranch
+	if branch == "" {
+		branch = p.Commit.Branch
+	}
+
+	labels := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for _, kv := range [][2]string{
+		{PreviewBranchLabel, branch},
+		{PreviewCommitLabel, p.Commit.Sha},
+		{PreviewBuildLabel, p.Build.Link},
+	} {
+		labels.Content = append(labels.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: kv[0]},
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: kv[1]},
+		)
+	}
+
+	root := doc.Content[0]
+	i := mappingIndex(root, "services")
+	if i < 0 {
+		return config, nil
+	}
+
+	services := root.Content[i+1]
+	if services.Kind != yaml.MappingNode {
+		return config, nil
+	}
+
+	for j := 1; j < len(services.Content); j += 2 {
+		service := services.Content[j]
+		if service.Kind != yaml.MappingNode {
+			continue
+		}
+
+		addLabels(service, labels)
+		if swarm {
+			k := mappingIndex(service, "deploy")
+			if k < 0 {
+				service.Content = append(service.Content,
+					&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "deploy"},
+					&yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"},
+				)
+				k = len(service.Content) - 2
+			}
+			if service.Content[k+1].Kind == yaml.MappingNode {
+				addLabels(service.Content[k+1], labels)
+			}
+		}
+	}
+
+	return encodeYAML(root)
+}
+
+// addLabels merges labels into the labels key of n, which may be a mapping or a KEY=VALUE list.
+func addLabels(n *yaml.Node, labels *yaml.Node) {
+	k := mappingIndex(n, "labels")
+	if k < 0 {
+		n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "labels"}, labels)
+		return
+	}
+	n.Content[k+1] = mergeNode("labels", n.Content[k+1], labels)
+}
+
+// sweep removes preview stacks of the endpoint which are older than the TTL
+// or whose branch is not in the list of branches. Only stacks with the preview
+// branch label are swept, other stacks sharing the prefix are left alone.
+func (p Plugin) sweep(ctx context.Context, prtnr *portainer.Portainer, s Stack, log *slog.Logger) error {
+	preview := p.Config.Preview
+	if preview.TTL <= 0 && len(preview.Branches) == 0 {
+		return fmt.Errorf("Preview TTL or branches required to sweep preview stacks")
+	}
+
+	prefix := sanitize(preview.Prefix)
+	if prefix == "" {
+		return fmt.Errorf("Preview prefix not defined")
+	}
+	prefix += "-"
+
+	endpoint, err := p.selectEndpoint(ctx, prtnr, s, log)
+	if err != nil {
+		return err
+	}
+
+	ph := begin(log, "search_previews", "Search preview stacks", "prefix", prefix)
+	stacks, err := prtnr.FindStacksContext(ctx, &portainer.StackFilters{EndpointID: endpoint.Id})
+	if err != nil {
+		return ph.fail(err)
+	}
+	ph.ok()
+
+	failed := 0
+	for _, stack := range stacks {
+		if !strings.HasPrefix(stack.Name, prefix) {
+			continue
+		}
+
+		file, err := prtnr.GetStackFileContext(ctx, stack)
+		if err != nil {
+			log.Error("Preview stack file not available", "preview", stack.Name, "error", err)
+			failed++
+			continue
+		}
+
+		branch, ok := previewBranch(file)
+		if !ok {
+			log.Info("Skip stack without preview label", "stack", stack.Name)
+			continue
+		}
+
+		reason := sweepReason(preview, stack, branch, time.Now())
+		if reason == "" {
+			log.Info("Keep preview stack", "preview", stack.Name, "branch", branch)
+			continue
+		}
+
+		log.Info("Sweep preview stack", "preview", stack.Name, "branch", branch, "reason", reason)
+		r := s
+		r.Name = stack.Name
+		r.Endpoint = endpoint.Name
+		r.EndpointID = endpoint.Id
+		if err := p.remove(ctx, prtnr, r, log.With("preview", stack.Name)); err != nil {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d preview stacks could not be removed", failed)
+	}
+
+	return nil
+}
+
+// sweepReason tells why the preview stack of the branch is to be removed,
+// it is empty if the stack is kept.
+func sweepReason(preview Preview, stack *portainer.Stack, branch string, now time.Time) string {
+	if updated := stackUpdated(stack); preview.TTL > 0 && !updated.IsZero() && now.Sub(updated) > preview.TTL {
+		return fmt.Sprintf("last updated %s ago", now.Sub(updated).Round(time.Second))
+	}
+
+	if len(preview.Branches) == 0 {
+		return ""
+	}
+	for _, active := range preview.Branches {
+		if active == branch {
+			return ""
+		}
+	}
+	return "branch no longer exists"
+}
+
+// previewBranch returns the preview branch label previewLabels put on the services
+// of the stack file.
+func previewBranch(config string) (string, bool) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(config), &doc); err != nil || len(doc.Content) == 0 {
+		return "", false
+	}
+
+	root := doc.Content[0]
+	i := mappingIndex(root, "services")
+	if i < 0 || root.Content[i+1].Kind != yaml.MappingNode {
+		return "", false
+	}
+
+	services := root.Content[i+1]
+	for j := 1; j < len(services.Content); j += 2 {
+		k := mappingIndex(services.Content[j], "labels")
+		if k < 0 {
+			continue
+		}
+
+		labels := services.Content[j].Content[k+1]
+		switch labels.Kind {
+		case yaml.MappingNode:
+			if l := mappingIndex(labels, PreviewBranchLabel); l >= 0 {
+				return labels.Content[l+1].Value, true
+			}
+		case yaml.SequenceNode:
+			for _, label := range labels.Content {
+				if value, ok := strings.CutPrefix(label.Value, PreviewBranchLabel+"="); ok {
+					return value, true
+				}
+			}
+		}
+	}
+
+	return "", false
+}
+
+// stackUpdated is the time of the last stack update, or its creation.
+func stackUpdated(stack *portainer.Stack) time.Time {
+	ts := stack.UpdateDate
+	if stack.CreationDate > ts {
+		ts = stack.CreationDate
+	}
+	if ts == 0 {
+		return time.Time{}
+	}
+	return time.Unix(ts, 0)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maniack/drone-portainer/lib/portainer"
+)
+
+// Stack names are lower case, trimmed and cut at the maximum length.
+func TestSanitize(t *testing.T) {
+	long := strings.Repeat("a", previewNameMax-1) + "-b"
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Feature/Login", "feature-login"},
+		{"feature//login", "feature-login"},
+		{"--fix_#12--", "fix_-12"},
+		{"_.", ""},
+		{long, strings.Repeat("a", previewNameMax-1)},
+		{strings.Repeat("x", 60), strings.Repeat("x", previewNameMax)},
+	}
+
+	for _, tt := range tests {
+		if got := sanitize(tt.name); got != tt.want {
+			t.Errorf("sanitize(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// distinct branches collide, which is why sweep compares labels
+	for _, branch := range []string{"Feature/Login", "feature.login", "feature--login"} {
+		if got := sanitize(branch); got != "feature-login" {
+			t.Errorf("sanitize(%q) = %q, want a collision with feature/login", branch, got)
+		}
+	}
+}
+
+// Pull requests are named by number, other builds by branch.
+func TestPreviewName(t *testing.T) {
+	tests := []struct {
+		event  string
+		pr     int
+		branch string
+		source string
+		want   string
+		err    bool
+	}{
+		{event: "push", branch: "feature/Login", want: "preview-feature-login"},
+		{event: "pull_request", pr: 42, branch: "main", source: "feature/login", want: "preview-pr-42"},
+		{event: "pull_request", branch: "main", source: "feature/login", want: "preview-feature-login"},
+		{event: "push", branch: "#!", err: true},
+	}
+
+	for _, tt := range tests {
+		var p Plugin
+		p.Config.Preview.Prefix = "Preview"
+		p.Build.Event = tt.event
+		p.Build.PullRequest = tt.pr
+		p.Commit.Branch = tt.branch
+		p.Commit.SourceBranch = tt.source
+
+		got, err := p.previewName()
+		if (err != nil) != tt.err {
+			t.Errorf("previewName(%s %q) error = %v", tt.event, tt.branch, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("previewName(%s %q) = %q, want %q", tt.event, tt.branch, got, tt.want)
+		}
+	}
+}
+
+// The branch label is read from mapping and list labels, stacks without it are no previews.
+func TestPreviewBranch(t *testing.T) {
+	tests := []struct {
+		config string
+		want   string
+		ok     bool
+	}{
+		{"services:\n  web:\n    labels:\n      drone.preview.branch: feature/login\n", "feature/login", true},
+		{"services:\n  web:\n    image: nginx\n  api:\n    labels:\n      - drone.preview.branch=fix/1\n", "fix/1", true},
+		{"services:\n  web:\n    labels:\n      app: web\n", "", false},
+		{"services:\n  web:\n    image: nginx\n", "", false},
+		{"version: '3'\n", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := previewBranch(tt.config)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("previewBranch(%q) = %q, %v, want %q, %v", tt.config, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	// the labels previewLabels writes are found again
+	var p Plugin
+	p.Commit.Branch = "Feature/Login"
+	config, err := p.previewLabels("services:\n  web:\n    image: nginx\n", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := previewBranch(config); got != "Feature/Login" || !ok {
+		t.Errorf("previewBranch(previewLabels()) = %q, %v", got, ok)
+	}
+}
+
+// Stacks are swept after the TTL or when their labeled branch is not listed.
+func TestSweepReason(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	fresh := &portainer.Stack{CreationDate: now.Add(-time.Hour).Unix()}
+	old := &portainer.Stack{CreationDate: now.Add(-72 * time.Hour).Unix(), UpdateDate: now.Add(-48 * time.Hour).Unix()}
+	undated := &portainer.Stack{}
+
+	tests := []struct {
+		preview Preview
+		stack   *portainer.Stack
+		branch  string
+		want    string
+	}{
+		{Preview{TTL: 24 * time.Hour}, fresh, "main", ""},
+		{Preview{TTL: 24 * time.Hour}, old, "main", "last updated"},
+		{Preview{TTL: 24 * time.Hour}, undated, "main", ""},
+		{Preview{Branches: []string{"main", "feature/login"}}, old, "feature/login", ""},
+		{Preview{Branches: []string{"main", "feature/login"}}, fresh, "feature.login", "branch no longer exists"},
+		{Preview{Branches: []string{"main"}}, fresh, "Main", "branch no longer exists"},
+		{Preview{TTL: 24 * time.Hour, Branches: []string{"main"}}, old, "main", "last updated"},
+	}
+
+	for _, tt := range tests {
+		got := sweepReason(tt.preview, tt.stack, tt.branch, now)
+		if (tt.want == "") != (got == "") || !strings.HasPrefix(got, tt.want) {
+			t.Errorf("sweepReason(%+v, %q) = %q, want %q", tt.preview, tt.branch, got, tt.want)
+		}
+	}
+}
+
+// Sweep only removes labeled previews, whatever names other stacks of the prefix have.
+func TestSweepSelection(t *testing.T) {
+	files := map[string]string{
+		"1": "services:\n  web:\n    labels:\n      drone.preview.branch: main\n",
+		"2": "services:\n  web:\n    labels:\n      drone.preview.branch: feature.login\n",
+		"3": "services:\n  web:\n    labels:\n      - drone.preview.branch=feature/login\n",
+		"4": "services:\n  web:\n    image: nginx\n",
+		"5": "services:\n  web:\n    labels:\n      drone.preview.branch: old\n",
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch path := r.URL.Path; {
+		case path == "/api/endpoints/1":
+			w.Write([]byte(`{"Id":1,"Name":"local","Type":1}`))
+		case path == "/api/endpoints/1/docker/info":
+			w.Write([]byte(`{}`))
+		case path == "/api/stacks":
+			w.Write([]byte(`[
+				{"Id":1,"Name":"preview-main","Type":2,"EndpointID":1},
+				{"Id":2,"Name":"preview-feature-login","Type":2,"EndpointID":1},
+				{"Id":3,"Name":"preview-pr-7","Type":2,"EndpointID":1},
+				{"Id":4,"Name":"preview-manual","Type":2,"EndpointID":1},
+				{"Id":5,"Name":"app","Type":2,"EndpointID":1}
+			]`))
+		case strings.HasPrefix(path, "/api/stacks/") && strings.HasSuffix(path, "/file"):
+			id := strings.TrimSuffix(strings.TrimPrefix(path, "/api/stacks/"), "/file")
+			json.NewEncoder(w).Encode(map[string]string{"StackFileContent": files[id]})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	prtnr, err := portainer.NewPortainer(srv.URL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var p Plugin
+	p.Config.DryRun = true
+	p.Config.Preview = Preview{Prefix: "preview", Branches: []string{"main", "feature/login"}}
+
+	var out bytes.Buffer
+	log := slog.New(slog.NewTextHandler(&out, nil))
+	if err := p.sweep(context.Background(), prtnr, Stack{EndpointID: 1}, log); err != nil {
+		t.Fatal(err)
+	}
+
+	var swept []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.Contains(line, `msg="Sweep preview stack"`) {
+			swept = append(swept, line)
+		}
+	}
+	if len(swept) != 1 || !strings.Contains(swept[0], "preview=preview-feature-login") {
+		t.Errorf("sweep() swept %q, want preview-feature-login only", swept)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/maniack/drone-portainer/lib/portainer"
+)
+
+// remove deletes a stack. A stack which is already gone is not an error.
+func (p Plugin) remove(ctx context.Context, prtnr *portainer.Portainer, s Stack, log *slog.Logger) error {
+	endpoint, err := p.selectEndpoint(ctx, prtnr, s, log)
+	if err != nil {
+		return err
+	}
+
+	ph := begin(log, "search_stack", "Search stack")
+	stack, err := prtnr.GetStackContext(ctx, endpoint, s.Name)
+	if err != nil {
+		return ph.fail(err)
+	}
+	ph.ok("found", stack != nil)
+
+	if stack == nil {
+		log.Info("Stack not found, nothing to remove")
+	} else {
+		if stack.Type != 0 {
+			endpoint.StackType = stack.Type
+		}
+
+		if p.Config.DryRun {
+			log.Info("Stack would be removed", "stack_id", stack.Id)
+			return nil
+		}
+
+		ph := begin(log, "remove", "Remove stack", "stack_id", stack.Id)
+		err = prtnr.DeleteStackContext(ctx, stack)
+		if errors.Is(err, portainer.ErrNotFound) {
+			ph.ok("already_removed", true)
+		} else if err != nil {
+			return ph.fail(err)
+		} else {
+			ph.ok()
+		}
+	}
+
+	if p.Config.DryRun || endpoint.IsKubernetes() {
+		return nil
+	}
+
+	return p.removeResources(ctx, prtnr, endpoint, s, log)
+}
+
+// removeResources deletes the volumes and networks left behind by a removed stack.
+// Resources are retried until the stack's containers are gone or the wait timeout expires.
+func (p Plugin) removeResources(ctx context.Context, prtnr *portainer.Portainer, endpoint *portainer.Endpoint, s Stack, log *slog.Logger) error {
+	deadline := time.Now().Add(s.WaitTimeout)
+
+	retry := func(what string, name string, fn func() error) error {
+		ph := begin(log, "remove_"+what, "Remove "+what, what, name)
+		for {
+			err := fn()
+			if err == nil {
+				ph.ok()
+				return nil
+			}
+			// a retried delete may have succeeded before
+			if errors.Is(err, portainer.ErrNotFound) {
+				ph.ok("already_removed", true)
+				return nil
+			}
+			if time.Now().After(deadline) || ctx.Err() != nil {
+				return ph.fail(err)
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(s.WaitInterval):
+			}
+		}
+	}
+
+	if s.RemoveVolumes {
+		volumes, err := prtnr.GetStackVolumesContext(ctx, endpoint, s.Name)
+		if err != nil {
+			return err
+		}
+
+		for _, volume := range volumes {
+			err := retry("volume", volume.Name, func() error {
+				return prtnr.DeleteVolumeContext(ctx, endpoint, volume.Name)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if s.RemoveNetworks {
+		networks, err := prtnr.GetStackNetworksContext(ctx, endpoint, s.Name)
+		if err != nil {
+			return err
+		}
+
+		for _, network := range networks {
+			err := retry("network", network.Name, func() error {
+				return prtnr.DeleteNetworkContext(ctx, endpoint, network.Id)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Resources are deleted in a polling loop, a non-positive interval is refused up front.
+func TestRemoveWaitInterval(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	for _, interval := range []time.Duration{0, -time.Second} {
+		var p Plugin
+		p.Config.Action = "remove"
+		p.Config.Portainer.Address = srv.URL
+		p.Config.Stack = Stack{Name: "web", RemoveVolumes: true, WaitTimeout: time.Minute, WaitInterval: interval}
+
+		err := p.Exec(slog.New(slog.NewTextHandler(io.Discard, nil)))
+		if err == nil || !strings.Contains(err.Error(), "wait interval must be positive") {
+			t.Errorf("Exec() with interval %s error = %v", interval, err)
+		}
+	}
+}
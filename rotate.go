@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/maniack/drone-portainer/lib/portainer"
+	"gopkg.in/yaml.v3"
+)
+
+// rotateLabel groups all versions of a rotated config or secret.
+const rotateLabel = "drone-portainer.rotate"
+
+type rotatedObject struct {
+	kind  string
+	group string
+	name  string
+	id    string
+}
+
+// dir is the directory relative file references of the stack file are resolved from.
+func (s Stack) dir() string {
+	switch {
+	case len(s.Config) > 0:
+		return "."
+	case len(s.Files) > 0:
+		return filepath.Dir(s.Files[0])
+	case s.Path != "":
+		return filepath.Dir(s.Path)
+	}
+	return "."
+}
+
+// rotate replaces the file based and inline configs and secrets of the stack file
+// with external swarm objects named after a hash of their content. The objects are
+// only created when create is set; external entries are left as they are.
+func (p Plugin) rotate(ctx context.Context, prtnr *portainer.Portainer, endpoint *portainer.Endpoint, s Stack, config string, create bool) (string, []*rotatedObject, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(config), &doc); err != nil {
+		return "", nil, fmt.Errorf("Stack file parsing error : %s", err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return config, nil, nil
+	}
+	root := doc.Content[0]
+
+	var rotated []*rotatedObject
+	for _, kind := range []string{portainer.SwarmConfigs, portainer.SwarmSecrets} {
+		j := mappingIndex(root, kind)
+		if j < 0 || root.Content[j+1].Kind != yaml.MappingNode {
+			continue
+		}
+		section := root.Content[j+1]
+
+		for i := 0; i+1 < len(section.Content); i += 2 {
+			key, entry := section.Content[i].Value, section.Content[i+1]
+
+			var data []byte
+			if k := mappingIndex(entry, "file"); k >= 0 {
+				path := entry.Content[k+1].Value
+				if !filepath.IsAbs(path) {
+					path = filepath.Join(s.dir(), path)
+				}
+
+				var err error
+				data, err = ioutil.ReadFile(path)
+				if err != nil {
+					return "", nil, err
+				}
+			} else if k := mappingIndex(entry, "content"); k >= 0 {
+				data = []byte(entry.Content[k+1].Value)
+			} else {
+				continue
+			}
+
+			sum := sha256.Sum256(data)
+			object := &rotatedObject{
+				kind:  kind,
+				group: fmt.Sprintf("%s_%s", s.Name, key),
+			}
+			object.name = fmt.Sprintf("%s-%x", object.group, sum[:5])
+
+			if create {
+				existing, err := prtnr.GetSwarmObjectByNameContext(ctx, endpoint, kind, object.name)
+				if err != nil {
+					return "", nil, err
+				}
+
+				if existing != nil {
+					object.id = existing.ID
+				} else {
+					object.id, err = prtnr.CreateSwarmObjectContext(ctx, endpoint, kind, object.name, data, map[string]string{
+						portainer.StackNamespaceLabel: s.Name,
+						rotateLabel:                   object.group,
+					})
+					if err != nil {
+						return "", nil, err
+					}
+				}
+			}
+
+			section.Content[i+1] = &yaml.Node{
+				Kind: yaml.MappingNode,
+				Tag:  "!!map",
+				Content: []*yaml.Node{
+					{Kind: yaml.ScalarNode, Tag: "!!str", Value: "name"},
+					{Kind: yaml.ScalarNode, Tag: "!!str", Value: object.name},
+					{Kind: yaml.ScalarNode, Tag: "!!str", Value: "external"},
+					{Kind: yaml.ScalarNode, Tag: "!!bool", Value: "true"},
+				},
+			}
+			rotated = append(rotated, object)
+		}
+	}
+
+	if len(rotated) == 0 {
+		return config, nil, nil
+	}
+
+	config, err := encodeYAML(root)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return config, rotated, nil
+}
+
+// pruneRotated removes old versions of the rotated objects, keeping the current
+// one and the newest others up to retention. Objects still used by a service are
+// left as they are, Docker refuses to delete them.
+func (p Plugin) pruneRotated(ctx context.Context, prtnr *portainer.Portainer, endpoint *portainer.Endpoint, rotated []*rotatedObject, retention int, log *slog.Logger) {
+	for _, object := range rotated {
+		ph := begin(log, "prune", "List rotated objects", "kind", object.kind, "group", object.group)
+		objects, err := prtnr.GetSwarmObjectsContext(ctx, endpoint, object.kind, fmt.Sprintf("%s=%s", rotateLabel, object.group))
+		if err != nil {
+			ph.skip(err)
+			continue
+		}
+
+		sort.Slice(objects, func(i, j int) bool {
+			a, _ := time.Parse(time.RFC3339Nano, objects[i].CreatedAt)
+			b, _ := time.Parse(time.RFC3339Nano, objects[j].CreatedAt)
+			return a.After(b)
+		})
+
+		kept := 1
+		for _, o := range objects {
+			if o.ID == object.id {
+				continue
+			}
+			if kept < retention {
+				kept++
+				continue
+			}
+
+			ph := begin(log, "prune", "Remove rotated object", "kind", object.kind, "name", o.Spec.Name)
+			if err := prtnr.DeleteSwarmObjectContext(ctx, endpoint, object.kind, o.ID); err != nil {
+				ph.skip(err)
+				continue
+			}
+			ph.ok()
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/maniack/drone-portainer/lib/portainer"
+)
+
+func (p Plugin) start(ctx context.Context, prtnr *portainer.Portainer, s Stack, log *slog.Logger) error {
+	return p.setState(ctx, prtnr, s, true, log)
+}
+
+func (p Plugin) stop(ctx context.Context, prtnr *portainer.Portainer, s Stack, log *slog.Logger) error {
+	return p.setState(ctx, prtnr, s, false, log)
+}
+
+// setState starts or stops an existing stack. A stack already in the requested state is left alone.
+func (p Plugin) setState(ctx context.Context, prtnr *portainer.Portainer, s Stack, active bool, log *slog.Logger) error {
+	verb, done, state, status := "Stop", "stopped", "stopped", portainer.StackStatusInactive
+	if active {
+		verb, done, state, status = "Start", "started", "running", portainer.StackStatusActive
+	}
+
+	endpoint, err := p.selectEndpoint(ctx, prtnr, s, log)
+	if err != nil {
+		return err
+	}
+
+	ph := begin(log, "search_stack", "Search stack")
+	stack, err := prtnr.GetStackContext(ctx, endpoint, s.Name)
+	if err != nil {
+		return ph.fail(err)
+	}
+	if stack == nil {
+		return ph.fail(fmt.Errorf("Stack \"%s\" not found on endpoint \"%s\"", s.Name, endpoint.Name))
+	}
+	ph.ok("found", true, "stack_id", stack.Id)
+
+	if stack.Status == status {
+		log.Info("Stack is already "+state, "state", state)
+		return nil
+	}
+
+	if p.Config.DryRun {
+		log.Info("Stack would be "+done, "state", state)
+		return nil
+	}
+
+	ph = begin(log, strings.ToLower(verb), verb+" stack", "stack_id", stack.Id)
+	if active {
+		err = prtnr.StartStackContext(ctx, stack)
+	} else {
+		err = prtnr.StopStackContext(ctx, stack)
+	}
+	if err != nil {
+		return ph.fail(err)
+	}
+	ph.ok("state", state)
+
+	return nil
+}
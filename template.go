@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/maniack/drone-portainer/lib/portainer"
+)
+
+// buildVar matches the ${DRONE_*} and ${CI_*} references of a stack file, with
+// an optional :-default, and $$ which escapes a dollar sign in compose files.
+var buildVar = regexp.MustCompile(`\$\$|\$\{((?:DRONE|CI)_[A-Za-z0-9_]*)(:-[^}]*)?\}`)
+
+// templateData is what stack file templates are rendered with.
+type templateData struct {
+	Repo   Repo
+	Build  Build
+	Commit Commit
+	Stack  string
+	Env    map[string]string
+}
+
+// templateFuncs are the helpers of stack file templates. env only reads the
+// variables exposed by envExposed.
+func templateFuncs(strict bool, secrets []string) template.FuncMap {
+	return template.FuncMap{
+		"env": func(name string) (string, error) {
+			if !envExposed(secrets, name) {
+				return "", fmt.Errorf("Environment variable \"%s\" not available to templates, add it to secrets", name)
+			}
+			value, ok := os.LookupEnv(name)
+			if !ok && strict {
+				return "", fmt.Errorf("Environment variable \"%s\" not defined", name)
+			}
+			return value, nil
+		},
+		"default": func(def string, value interface{}) string {
+			if s := fmt.Sprint(value); value != nil && s != "" {
+				return s
+			}
+			return def
+		},
+		"required": func(name string, value interface{}) (interface{}, error) {
+			if value == nil || fmt.Sprint(value) == "" {
+				return nil, fmt.Errorf("Template value \"%s\" is required", name)
+			}
+			return value, nil
+		},
+		"trunc": func(n int, s string) string {
+			if len(s) > n {
+				return s[:n]
+			}
+			return s
+		},
+		"lower":      strings.ToLower,
+		"upper":      strings.ToUpper,
+		"trim":       strings.TrimSpace,
+		"replace":    func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+		"hasPrefix":  strings.HasPrefix,
+		"hasSuffix":  strings.HasSuffix,
+		"contains":   strings.Contains,
+		"trimPrefix": strings.TrimPrefix,
+		"trimSuffix": strings.TrimSuffix,
+	}
+}
+
+// render executes the stack file as a Go template with the build metadata.
+func (p Plugin) render(s Stack, config string, env []*portainer.Env) (string, error) {
+	data := templateData{
+		Repo:   p.Repo,
+		Build:  p.Build,
+		Commit: p.Commit,
+		Stack:  s.Name,
+		Env:    map[string]string{},
+	}
+	for _, e := range env {
+		data.Env[e.Name] = e.Value
+	}
+
+	tmpl := template.New(s.Name).Funcs(templateFuncs(s.TemplateStrict, p.Config.Secrets))
+	if s.TemplateStrict {
+		tmpl = tmpl.Option("missingkey=error")
+	}
+
+	tmpl, err := tmpl.Parse(config)
+	if err != nil {
+		return "", fmt.Errorf("Stack template parsing error : %s", err)
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("Stack template rendering error : %s", err)
+	}
+
+	return expandBuildVars(out.String(), s.TemplateStrict)
+}
+
+// expandBuildVars replaces ${DRONE_*} and ${CI_*} in the stack file with the
+// build variables. Other variables are left to Portainer, which resolves them
+// against the stack environment.
+func expandBuildVars(config string, strict bool) (string, error) {
+	var err error
+	config = buildVar.ReplaceAllStringFunc(config, func(ref string) string {
+		m := buildVar.FindStringSubmatch(ref)
+		if m[1] == "" {
+			return ref
+		}
+
+		value, ok := os.LookupEnv(m[1])
+		switch {
+		case m[2] != "" && value == "":
+			return m[2][2:]
+		case !ok && strict && err == nil:
+			err = fmt.Errorf("Environment variable \"%s\" not defined", m[1])
+		}
+		return value
+	})
+
+	return config, err
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+// Only build variables are expanded, the others are resolved by Portainer.
+func TestExpandBuildVars(t *testing.T) {
+	t.Setenv("DRONE_COMMIT_SHA", "0123abcd")
+	t.Setenv("DRONE_EMPTY", "")
+	t.Setenv("APP_TAG", "latest")
+
+	tests := []struct {
+		name   string
+		config string
+		strict bool
+		want   string
+		err    bool
+	}{
+		{"build variable", "image: registry/app:${DRONE_COMMIT_SHA}", false, "image: registry/app:0123abcd", false},
+		{"stack variable", "image: registry/app:${APP_TAG}", false, "image: registry/app:${APP_TAG}", false},
+		{"plain reference", "image: registry/app:$DRONE_COMMIT_SHA", false, "image: registry/app:$DRONE_COMMIT_SHA", false},
+		{"escaped", "command: echo $${DRONE_COMMIT_SHA}", false, "command: echo $${DRONE_COMMIT_SHA}", false},
+		{"default of unset", "tag: ${DRONE_TAG:-dev}", false, "tag: dev", false},
+		{"default of empty", "tag: ${DRONE_EMPTY:-dev}", false, "tag: dev", false},
+		{"default of set", "tag: ${DRONE_COMMIT_SHA:-dev}", false, "tag: 0123abcd", false},
+		{"unset", "tag: ${CI_UNSET}", false, "tag: ", false},
+		{"unset strict", "tag: ${CI_UNSET}", true, "", true},
+		{"empty strict", "tag: ${DRONE_EMPTY}", true, "tag: ", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandBuildVars(tt.config, tt.strict)
+			if (err != nil) != tt.err {
+				t.Fatalf("expandBuildVars() error = %v, want error %v", err, tt.err)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("expandBuildVars() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}